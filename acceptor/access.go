@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the access log is configured with environment variables
+//
+//	ACCESS_LOG            file to write to, default access.log, off to disable
+//	ACCESS_LOG_FORMAT     json (default) or combined
+//	ACCESS_LOG_FIELDS     comma separated fields to log, default all of them
+//	ACCESS_LOG_MAX_SIZE   size in MB at which the file is rotated, default 100
+//	ACCESS_LOG_MAX_FILES  number of rotated files to keep, default 5
+const (
+	defaultAccessLog      = "access.log"
+	defaultAccessMaxSize  = 100
+	defaultAccessMaxFiles = 5
+)
+
+// the fields that can be logged, in the order they are logged
+var accessFields = []string{
+	"time", "remote_addr", "method", "uri", "proto", "host", "status",
+	"bytes", "duration_ms", "route", "responder_status", "request_id",
+	"referer", "user_agent",
+}
+
+// fields that are already part of the Combined Log Format, the others are
+// appended to each line
+var combinedFields = map[string]bool{
+	"time": true, "remote_addr": true, "method": true, "uri": true,
+	"proto": true, "status": true, "bytes": true, "referer": true,
+	"user_agent": true,
+}
+
+// AccessLog writes a line for every request handled by the acceptor
+type AccessLog struct {
+	format string
+	fields []string
+	out    *rotatingFile
+}
+
+var accessLog *AccessLog
+
+// set up the access log from the environment
+func setupAccessLog() (err error) {
+	path := os.Getenv("ACCESS_LOG")
+	if path == "off" {
+		return
+	}
+	if path == "" {
+		path = defaultAccessLog
+	}
+	format := os.Getenv("ACCESS_LOG_FORMAT")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "combined" {
+		return fmt.Errorf("unknown access log format %q", format)
+	}
+	fields, err := parseAccessFields(os.Getenv("ACCESS_LOG_FIELDS"))
+	if err != nil {
+		return
+	}
+	out, err := openRotatingFile(path,
+		int64(envInt("ACCESS_LOG_MAX_SIZE", defaultAccessMaxSize))<<20,
+		envInt("ACCESS_LOG_MAX_FILES", defaultAccessMaxFiles))
+	if err != nil {
+		return
+	}
+	accessLog = &AccessLog{format: format, fields: fields, out: out}
+	return
+}
+
+// parse the list of fields to log, keeping them in the standard order
+func parseAccessFields(list string) (fields []string, err error) {
+	if strings.TrimSpace(list) == "" {
+		return accessFields, nil
+	}
+	wanted := make(map[string]bool)
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		known := false
+		for _, field := range accessFields {
+			if f == field {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown access log field %q", f)
+		}
+		wanted[f] = true
+	}
+	for _, field := range accessFields {
+		if wanted[field] {
+			fields = append(fields, field)
+		}
+	}
+	return
+}
+
+// get a positive integer from the environment, or the default
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil && n > 0 {
+			return n
+		}
+		warning("Ignoring invalid", name, v)
+	}
+	return def
+}
+
+// the values of all the fields for a request
+func accessValues(request *http.Request, recorder *responseRecorder, ex *exchange, start time.Time, duration time.Duration) map[string]interface{} {
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return map[string]interface{}{
+		"time":             start,
+		"remote_addr":      host,
+		"method":           request.Method,
+		"uri":              request.RequestURI,
+		"proto":            request.Proto,
+		"host":             request.Host,
+		"status":           status,
+		"bytes":            recorder.size,
+		"duration_ms":      float64(duration) / float64(time.Millisecond),
+		"route":            ex.route,
+		"responder_status": ex.responderStatus,
+		"request_id":       ex.requestId,
+		"referer":          request.Referer(),
+		"user_agent":       request.UserAgent(),
+	}
+}
+
+// format a log line for the request
+func (l *AccessLog) line(values map[string]interface{}) []byte {
+	if l.format == "combined" {
+		return l.combined(values)
+	}
+	entry := make(map[string]interface{}, len(l.fields))
+	for _, field := range l.fields {
+		v := values[field]
+		if t, ok := v.(time.Time); ok {
+			v = t.Format(time.RFC3339Nano)
+		}
+		entry[field] = v
+	}
+	data, _ := json.Marshal(entry)
+	return append(data, '\n')
+}
+
+// Combined Log Format, with the other configured fields appended
+// eg 127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.1" 200 2326 "-" "curl/7.0" route="GET/_/" duration_ms=1.234
+func (l *AccessLog) combined(values map[string]interface{}) []byte {
+	quoted := func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return strconv.Quote(s)
+	}
+	bytes := "-"
+	if n := values["bytes"].(int64); n > 0 {
+		bytes = strconv.FormatInt(n, 10)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] %s %d %s %s %s",
+		values["remote_addr"],
+		values["time"].(time.Time).Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(fmt.Sprintf("%s %s %s", values["method"], values["uri"], values["proto"])),
+		values["status"],
+		bytes,
+		quoted(values["referer"].(string)),
+		quoted(values["user_agent"].(string)),
+	)
+	for _, field := range l.fields {
+		if combinedFields[field] {
+			continue
+		}
+		switch v := values[field].(type) {
+		case string:
+			fmt.Fprintf(&b, " %s=%s", field, quoted(v))
+		case float64:
+			fmt.Fprintf(&b, " %s=%.3f", field, v)
+		default:
+			fmt.Fprintf(&b, " %s=%v", field, v)
+		}
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// log a request
+func (l *AccessLog) log(request *http.Request, recorder *responseRecorder, ex *exchange, start time.Time, duration time.Duration) {
+	if l == nil {
+		return
+	}
+	_, err := l.out.Write(l.line(accessValues(request, recorder, ex, start, duration)))
+	if err != nil {
+		danger("Cannot write access log", err)
+	}
+}
+
+// rotatingFile is a file that is rotated when it reaches its maximum size,
+// keeping a number of rotated files named file.1, file.2 and so on, with
+// file.1 being the most recent
+type rotatingFile struct {
+	mutex    sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (r *rotatingFile, err error) {
+	r = &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	err = r.open()
+	return
+}
+
+func (r *rotatingFile) open() (err error) {
+	r.file, err = os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	fi, err := r.file.Stat()
+	if err != nil {
+		return
+	}
+	r.size = fi.Size()
+	return
+}
+
+func (r *rotatingFile) Write(p []byte) (n int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err = r.rotate()
+		if err != nil {
+			return
+		}
+	}
+	n, err = r.file.Write(p)
+	r.size += int64(n)
+	return
+}
+
+// shift the rotated files along, dropping the oldest, and start a new file
+func (r *rotatingFile) rotate() (err error) {
+	r.file.Close()
+	os.Remove(r.path + "." + strconv.Itoa(r.maxFiles))
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+	}
+	err = os.Rename(r.path, r.path+".1")
+	if err != nil {
+		return
+	}
+	return r.open()
+}
+
+// close the file
+func (r *rotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAccessValues() map[string]interface{} {
+	request := httptest.NewRequest("GET", "/_/users/42?x=1", nil)
+	request.Header.Set("User-Agent", "curl/8.0")
+	recorder := &responseRecorder{status: 404, size: 12}
+	ex := &exchange{route: "GET/_/users/:id", requestId: "abc", responderStatus: "404"}
+	start := time.Date(2000, 10, 10, 13, 55, 36, 0, time.UTC)
+	return accessValues(request, recorder, ex, start, 1500*time.Microsecond)
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	fields, err := parseAccessFields("status, route,request_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &AccessLog{format: "json", fields: fields}
+	entry := map[string]interface{}{}
+	err = json.Unmarshal(l.line(testAccessValues()), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entry) != 3 || entry["status"] != 404.0 || entry["route"] != "GET/_/users/:id" || entry["request_id"] != "abc" {
+		t.Error("wrong entry:", entry)
+	}
+	if _, err := parseAccessFields("status,nope"); err == nil {
+		t.Error("unknown field accepted")
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	fields, _ := parseAccessFields("")
+	l := &AccessLog{format: "combined", fields: fields}
+	line := string(l.line(testAccessValues()))
+	want := `192.0.2.1 - - [10/Oct/2000:13:55:36 +0000] "GET /_/users/42?x=1 HTTP/1.1" 404 12 "-" "curl/8.0" host="example.com" duration_ms=1.500 route="GET/_/users/:id" responder_status="404" request_id="abc"` + "\n"
+	if line != want {
+		t.Errorf("wrong line:\n%s\nwant:\n%s", line, want)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := r.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, want := range map[string]string{path: "dddddddd\n", path + ".1": "cccccccc\n", path + ".2": "bbbbbbbb\n"} {
+		data, err := os.ReadFile(file)
+		if err != nil || string(data) != want {
+			t.Error(file, "has", strings.TrimSpace(string(data)), err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("kept more files than allowed")
+	}
+}
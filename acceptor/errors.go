@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the responders' bin directory, where the manifest copies app files to
+var binDir = "../responder/bin"
+
+// Problem is a problem details body as described in RFC 7807
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Route     string `json:"route,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// error pages declared by the app in the manifest, keyed by status code
+// or "default", used instead of JSON for clients that accept HTML
+var errorPages = struct {
+	sync.RWMutex
+	templates map[string]*template.Template
+}{templates: make(map[string]*template.Template)}
+
+// parse the error page templates declared in the manifest
+// the template file names are relative to the bin directory
+func loadErrorPages(pages map[string]string) {
+	templates := make(map[string]*template.Template)
+	for code, file := range pages {
+		t, err := template.ParseFiles(filepath.Join(binDir, file))
+		if err != nil {
+			warning("Cannot parse error page", file, err)
+			continue
+		}
+		templates[code] = t
+	}
+	errorPages.Lock()
+	errorPages.templates = templates
+	errorPages.Unlock()
+}
+
+// find the error page for the status, falling back to the default page
+func errorPage(status int) (t *template.Template) {
+	errorPages.RLock()
+	defer errorPages.RUnlock()
+	t = errorPages.templates[strconv.Itoa(status)]
+	if t == nil {
+		t = errorPages.templates["default"]
+	}
+	return
+}
+
+// reply with an error, as problem details JSON or as the app's error page
+func fail(writer http.ResponseWriter, request *http.Request, routeId string, status int, detail string) {
+	problem := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  request.URL.Path,
+		Route:     routeId,
+		RequestID: writer.Header().Get(requestIDHeader),
+	}
+	warning(status, problem.Title, routeId, problem.RequestID, detail)
+
+	if t := errorPage(status); t != nil && strings.Contains(request.Header.Get("Accept"), "text/html") {
+		var buf bytes.Buffer
+		err := t.Execute(&buf, problem)
+		if err == nil {
+			writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+			reply(writer, status, buf.Bytes())
+			return
+		}
+		danger("Cannot render error page", err)
+	}
+
+	body, _ := json.Marshal(problem)
+	writer.Header().Set("Content-Type", "application/problem+json")
+	reply(writer, status, body)
+}
+
+// check if reading the request body failed because it exceeded the limit
+func tooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
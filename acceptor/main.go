@@ -6,165 +6,394 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
-	"github.com/nats-io/go-nats"
-	"io"
+	"github.com/nats-io/nats.go"
+	"github.com/sausheong/legion/trace"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	// "os"
+	"syscall"
 	"time"
+	"unicode/utf8"
+)
+
+// default server timeouts, routes with longer timeouts extend these
+const (
+	readTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
 )
 
 func main() {
 	router := httprouter.New()
 
 	addr := "0.0.0.0:8080"
-	router.GET("/_/*p", accept)
-	router.POST("/_/*p", accept)
+	err := loadRoutes(manifestFile)
+	if err != nil {
+		warning("Cannot load routes from manifest", err)
+	}
+	go reloadRoutes()
+
+	err = setupAccessLog()
+	if err != nil {
+		danger("Cannot set up access log", err)
+		log.Fatalln("Cannot set up access log", err)
+	}
+
+	err = setupUploads()
+	if err != nil {
+		danger("Cannot create upload directory", err)
+		log.Fatalln("Cannot create upload directory", err)
+	}
+
+	err = connect()
+	if err != nil {
+		danger("Cannot connect to NATS server", err)
+		log.Fatalln("Cannot connect to NATS server", err)
+	}
+	go exportSpans()
+	err = collectMetrics()
+	if err != nil {
+		warning("Cannot collect responder metrics", err)
+	}
+
+	router.GET("/_health", health)
+	router.GET("/metrics", serveMetrics)
+	for _, method := range methods {
+		router.Handle(method, "/_/*p", observe(accept))
+	}
+	router.HEAD("/_/*p", observe(accept))
+	router.OPTIONS("/_/*p", observe(options))
 
 	router.ServeFiles("/_s/*filepath", http.Dir("../responder/bin/public"))
 	server := &http.Server{
 		Addr:           addr,
 		Handler:        router,
-		ReadTimeout:    time.Duration(10 * int64(time.Second)),
-		WriteTimeout:   time.Duration(10 * int64(time.Second)),
+		ReadTimeout:    readTimeout,
+		WriteTimeout:   writeTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
 	fmt.Println("Polyglot Acceptor", version(), "started at", addr)
-	server.ListenAndServe()
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			danger("Cannot start server", err)
+			log.Fatalln("Cannot start server", err)
+		}
+	}()
+	waitForShutdown(server)
 }
 
 // default handler
 func accept(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
 
-	// the multipart contains the multipart data
-	multipart := make(map[string][]Multipart)
+	// find the route for the request, the route ID is the NATS subject
+	// if no route pattern matches, use the method and path eg GET/_/path
+	// HEAD requests go to the GET responder unless the manifest has a HEAD
+	// route, and the body of the response is left out
+	method := request.Method
+	route, pathParams := routes.Match(method, request.URL.Path)
+	if route == nil && method == "HEAD" {
+		method = "GET"
+		route, pathParams = routes.Match(method, request.URL.Path)
+	}
+	if route == nil {
+		route = defaultRoute(method, request.URL.Path)
+	}
+	routeId := route.ID
+
+	// every request gets an ID, taken from the client if it sent one, which
+	// is passed on to the responder and echoed back in the response
+	requestId := setRequestID(writer, request)
+	ex := exchangeOf(request)
+	ex.route, ex.requestId = routeId, requestId
+	// unmatched requests share a label so the metrics don't grow with every path
+	if !route.fallback {
+		ex.label = routeId
+	}
+	metrics.begin(ex.label)
+	defer metrics.done(ex.label)
+
+	// enforce the route's limits
+	if !route.acquire() {
+		writer.Header().Set("Retry-After", "1")
+		fail(writer, request, routeId, http.StatusServiceUnavailable, "Too many concurrent requests for this route")
+		return
+	}
+	defer route.release()
+
+	// WebSocket routes are bridged to their responders over NATS
+	if route.Type == "websocket" {
+		socket(writer, request, route, pathParams)
+		return
+	}
+	// SSE routes relay the events on their stream to the client
+	if route.Type == "sse" {
+		events(writer, request, route)
+		return
+	}
+	if request.ContentLength > route.MaxBody {
+		fail(writer, request, routeId, http.StatusRequestEntityTooLarge, "Request body is too large")
+		return
+	}
+	request.Body = http.MaxBytesReader(writer, request.Body, route.MaxBody)
+	// allow the server enough time to read the request and wait for
+	// responders with timeouts longer than the server's defaults
+	controller := http.NewResponseController(writer)
+	controller.SetReadDeadline(time.Now().Add(route.Timeout + readTimeout))
+	controller.SetWriteDeadline(time.Now().Add(route.Timeout + writeTimeout))
+
+	parse := ex.span.Child("http parse", trace.Internal)
 
-	// if request is a POST, parse the multipartform for stuff in the forms
-	if request.Method == "POST" {
-		request.ParseMultipartForm(3 << 20)
-		if request.MultipartForm != nil {
-			for mk, mv := range request.MultipartForm.File {
-				var parts []Multipart
-				for _, v := range mv {
-					f, err := v.Open()
-					if err != nil {
-						danger("Cannot read multipart message", err)
-					}
-					var buf bytes.Buffer
-					_, err = io.Copy(&buf, f)
-					if err != nil {
-						danger("Cannot copy multipart message into buffer", err)
-					}
-					content := base64.StdEncoding.EncodeToString(buf.Bytes())
-					part := Multipart{
-						Filename:    v.Filename,
-						ContentType: v.Header["Content-Type"][0],
-						Content:     content,
-					}
-					parts = append(parts, part)
-				}
-				multipart[mk] = parts
+	// read the raw body so JSON, XML and other bodies reach the responder
+	// multipart bodies are sent as multipart data instead
+	var body []byte
+	var err error
+	if !strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/") {
+		body, err = ioutil.ReadAll(request.Body)
+		if err != nil {
+			if tooLarge(err) {
+				fail(writer, request, routeId, http.StatusRequestEntityTooLarge, "Request body is too large")
+			} else {
+				fail(writer, request, routeId, http.StatusBadRequest, "Cannot read request body")
 			}
+			return
 		}
+		// put the body back so the form can still be parsed from it
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
 	}
 
 	// the form contains data from the URL as well as the POST form
 	params := make(map[string][]string)
-	err := request.ParseForm()
+
+	// the multipart contains the multipart data, uploaded files are spooled
+	// to the upload directory and removed once the response is sent
+	multipart := make(map[string][]Multipart)
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/") {
+		var files []string
+		multipart, files, err = spool(request, params)
+		defer removeUploads(files)
+		if err != nil {
+			if tooLarge(err) {
+				fail(writer, request, routeId, http.StatusRequestEntityTooLarge, "Request body is too large")
+			} else {
+				fail(writer, request, routeId, http.StatusBadRequest, "Cannot read multipart form: "+err.Error())
+			}
+			return
+		}
+	}
+
+	err = request.ParseForm()
 	if err != nil {
-		danger("Failed to parse form", err)
+		if tooLarge(err) {
+			fail(writer, request, routeId, http.StatusRequestEntityTooLarge, "Request body is too large")
+		} else {
+			fail(writer, request, routeId, http.StatusBadRequest, "Cannot parse form: "+err.Error())
+		}
+		return
 	}
 
 	for fk, fv := range request.Form {
-		params[fk] = fv
+		params[fk] = append(params[fk], fv...)
 	}
 
-	reqInfo := RequestInfo{
-		Method: request.Method,
-		URL: URLInfo{
-			Scheme:   request.URL.Scheme,
-			Opaque:   request.URL.Opaque,
-			Host:     request.URL.Host,
-			Path:     request.URL.Path,
-			RawQuery: request.URL.RawQuery,
-			Fragment: request.URL.Fragment,
-		},
-		Proto:            request.Proto,
-		Header:           request.Header,
-		Body:             request.Body,
-		ContentLength:    request.ContentLength,
-		TransferEncoding: request.TransferEncoding,
-		Host:             request.Host,
-		Params:           params,
-		Multipart:        multipart,
-		RemoteAddr:       request.RemoteAddr,
-		RequestURI:       request.RequestURI,
-	}
+	parse.End()
+
+	// the trace continues in the responder as a child of the publish span
+	publish := ex.span.Child("nats publish", trace.Client)
+	publish.Set("messaging.destination", routeId)
+	reqInfo := newRequestInfo(request, method, params, pathParams)
+	reqInfo.RequestID = requestId
+	reqInfo.TraceParent = publish.TraceParent()
+	reqInfo.Timeout = route.Timeout.Milliseconds()
+	reqInfo.Body, reqInfo.BodyEncoding = encodeBody(body)
+	reqInfo.Multipart = multipart
 
 	// marshal the RequestInfo struct into JSON
 	reqJson, err := json.Marshal(reqInfo)
 	if err != nil {
-		danger("Failed to marshal the request into JSON", err)
+		danger("Failed to marshal the request into JSON", requestId, err)
+		fail(writer, request, routeId, http.StatusInternalServerError, "Cannot marshal request")
+		return
 	}
-	routeId := request.Method + request.URL.Path
 
-	// send request
-
-	conn, err := nats.Connect(nats.DefaultURL)
+	// send request, the reply comes back through the connection's shared
+	// reply inbox
+	response, err := conn.Request(routeId, reqJson, route.Timeout)
 	if err != nil {
-		danger("Cannot connect to NATS server", err)
+		publish.Fail(err.Error())
+		metrics.natsError(ex.label, err)
 	}
-	defer conn.Close()
-
-	response, err := conn.Request(routeId, reqJson, 1*time.Second)
-
-	if err := conn.LastError(); err != nil {
-		danger("Cannot send request to NATS server", err)
-	} else {
-		info("Sent request to NATS server")
+	publish.End()
+	switch err {
+	case nil:
+		info("Sent request to NATS server", routeId, requestId)
+	case nats.ErrTimeout:
+		fail(writer, request, routeId, http.StatusGatewayTimeout, "No response from responder in time")
+		return
+	case nats.ErrNoResponders:
+		fail(writer, request, routeId, http.StatusServiceUnavailable, "No responders running for this route")
+		return
+	default:
+		danger("Cannot send request to NATS server", routeId, requestId, err)
+		fail(writer, request, routeId, http.StatusServiceUnavailable, "Cannot send request to responder")
+		return
 	}
 
 	// set the identity to the route ID eg GET/_/path
 	respInfo := ResponseInfo{}
 	err = json.Unmarshal(response.Data, &respInfo)
 	if err != nil {
-		danger("Failed to unmarshal the response JSON into ResponseInfo", err)
+		danger("Failed to unmarshal the response JSON into ResponseInfo", routeId, requestId, err)
+		fail(writer, request, routeId, http.StatusBadGateway, "Malformed response from responder")
+		return
 	}
 
-	// write headers
-	for k, v := range respInfo.Header {
-		for _, val := range v {
-			writer.Header().Add(k, val)
+	// get status
+	ex.responderStatus = respInfo.Status
+	status, err := strconv.Atoi(respInfo.Status)
+	if err != nil || status < 100 || status > 999 {
+		fail(writer, request, routeId, http.StatusBadGateway, "Invalid status from responder: "+respInfo.Status)
+		return
+	}
+
+	// streamed bodies are relayed chunk by chunk as they arrive, to an inbox
+	// the responder is told about in the answer to its reply
+	if respInfo.Stream {
+		sub, err := conn.SubscribeSync(nats.NewInbox())
+		if err == nil {
+			defer sub.Unsubscribe()
+			err = response.Respond([]byte(sub.Subject))
 		}
+		if err != nil {
+			metrics.natsError(ex.label, err)
+			danger("Cannot take stream from responder", routeId, requestId, err)
+			fail(writer, request, routeId, http.StatusBadGateway, "Cannot take stream from responder")
+			return
+		}
+		copyHeaders(writer, respInfo)
+		stream(writer, request, sub, route, status)
+		return
 	}
 
-	// get status
-	status, err := strconv.Atoi(respInfo.Status)
+	// decode the body as declared by the responder, before the responder's
+	// headers are set so a failure is answered with the acceptor's own
+	data, err := decodeBody(respInfo.Body, respInfo.Encoding, contentType(respInfo.Header))
 	if err != nil {
-		reply(writer, 500, []byte(err.Error()))
+		fail(writer, request, routeId, http.StatusBadGateway, "Cannot decode response body: "+err.Error())
+		return
 	}
+	copyHeaders(writer, respInfo)
 
-	var data []byte
-	// get content type
-	ctype, hasCType := respInfo.Header["Content-Type"]
-	if hasCType == true {
-		if is_text_mime_type(ctype[0]) {
-			data = []byte(respInfo.Body)
-		} else {
-			data, _ = base64.StdEncoding.DecodeString(respInfo.Body)
+	// write status and body to response
+	if request.Method == "HEAD" {
+		if writer.Header().Get("Content-Length") == "" {
+			writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
 		}
-	} else {
-		data = []byte(respInfo.Body) // if not given the content type, assume it's text
+		writer.WriteHeader(status)
+		return
 	}
-	// write status and body to response
 	reply(writer, status, data)
 
 }
 
-func reply(writer http.ResponseWriter, status int, body []byte) {
-	writer.WriteHeader(status)
-	writer.Write(body)
+// write the responder's headers, the acceptor has already set the request ID
+func copyHeaders(writer http.ResponseWriter, respInfo ResponseInfo) {
+	for k, v := range respInfo.Header {
+		if http.CanonicalHeaderKey(k) == requestIDHeader {
+			continue
+		}
+		for _, val := range v {
+			writer.Header().Add(k, val)
+		}
+	}
+}
+
+// answer OPTIONS requests from the route table, unless the manifest has an
+// OPTIONS route for the path, in which case the responder answers instead
+func options(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+	if route, _ := routes.Match("OPTIONS", request.URL.Path); route != nil {
+		accept(writer, request, p)
+		return
+	}
+	exchangeOf(request).requestId = setRequestID(writer, request)
+	allowed := routes.Methods(request.URL.Path)
+	if len(allowed) == 0 {
+		fail(writer, request, "", http.StatusNotFound, "No routes for this path")
+		return
+	}
+	writer.Header().Set("Allow", strings.Join(allowed, ", "))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// create the request info sent to responders, without the body
+func newRequestInfo(request *http.Request, method string, params map[string][]string, pathParams map[string]string) RequestInfo {
+	return RequestInfo{
+		Method: method,
+		URL: URLInfo{
+			Scheme:   request.URL.Scheme,
+			Opaque:   request.URL.Opaque,
+			Host:     request.URL.Host,
+			Path:     request.URL.Path,
+			RawQuery: request.URL.RawQuery,
+			Fragment: request.URL.Fragment,
+		},
+		Proto:            request.Proto,
+		Header:           request.Header,
+		ContentLength:    request.ContentLength,
+		TransferEncoding: request.TransferEncoding,
+		Host:             request.Host,
+		Params:           params,
+		PathParams:       pathParams,
+		RemoteAddr:       request.RemoteAddr,
+		RequestURI:       request.RequestURI,
+	}
+}
+
+// encode the raw request body for the JSON envelope, text bodies are sent
+// as they are and anything that isn't valid UTF-8 is base64 encoded
+func encodeBody(body []byte) (encoded string, encoding string) {
+	switch {
+	case len(body) == 0:
+		return "", ""
+	case utf8.Valid(body):
+		return string(body), "text"
+	default:
+		return base64.StdEncoding.EncodeToString(body), "base64"
+	}
+}
+
+// decode the response body according to the encoding in the envelope
+// responders that don't set an encoding base64 encode bodies that aren't
+// text, going by the content type
+func decodeBody(body string, encoding string, contentType string) (data []byte, err error) {
+	if encoding == "" {
+		encoding = "text"
+		if contentType != "" && !is_text_mime_type(contentType) {
+			encoding = "base64"
+		}
+	}
+	switch encoding {
+	case "text":
+		data = []byte(body)
+	case "base64":
+		data, err = base64.StdEncoding.DecodeString(body)
+	default:
+		err = fmt.Errorf("unknown encoding %q", encoding)
+	}
+	return
+}
+
+// the content type in the responder's headers
+func contentType(header map[string][]string) string {
+	for k, v := range header {
+		if http.CanonicalHeaderKey(k) == "Content-Type" && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
 }
 
 func is_text_mime_type(ctype string) bool {
@@ -176,3 +405,20 @@ func is_text_mime_type(ctype string) bool {
 	}
 
 }
+
+// reload the routes from the manifest whenever the acceptor gets a SIGHUP
+func reloadRoutes() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		err := loadRoutes(manifestFile)
+		if err != nil {
+			danger("Cannot reload routes from manifest", err)
+		}
+	}
+}
+
+func reply(writer http.ResponseWriter, status int, body []byte) {
+	writer.WriteHeader(status)
+	writer.Write(body)
+}
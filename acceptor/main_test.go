@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x00}
+	encoded := base64.StdEncoding.EncodeToString(png)
+	tests := []struct {
+		body, encoding, contentType string
+		want                        []byte
+	}{
+		// responders from before the encoding field base64 encode binaries
+		{encoded, "", "image/png", png},
+		{"<p>hi</p>", "", "text/html; charset=utf-8", []byte("<p>hi</p>")},
+		{`{"a":1}`, "", "application/json", []byte(`{"a":1}`)},
+		{"hi", "", "", []byte("hi")},
+		// the encoding field wins over the content type
+		{"plain", "text", "image/png", []byte("plain")},
+		{encoded, "base64", "text/plain", png},
+	}
+	for _, test := range tests {
+		data, err := decodeBody(test.body, test.encoding, test.contentType)
+		if err != nil || !bytes.Equal(data, test.want) {
+			t.Errorf("decodeBody(%q, %q, %q) = %q, %v", test.body, test.encoding, test.contentType, data, err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats.go"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responders push their metrics to this subject, and the acceptor serves
+// them along with its own
+const metricsSubject = "_red.metrics"
+
+// responder metrics not pushed again within this time are dropped, as the
+// responder has most likely been stopped
+const metricsExpiry = 30 * time.Second
+
+// latency histogram buckets in seconds, the Prometheus defaults
+var buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram counts observations cumulatively into the buckets
+type histogram struct {
+	Counts []uint64 `json:"counts"`
+	Sum    float64  `json:"sum"`
+	Count  uint64   `json:"count"`
+}
+
+func newHistogram() *histogram {
+	return &histogram{Counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, le := range buckets {
+		if seconds <= le {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += seconds
+	h.Count++
+}
+
+// ResponderMetrics is the snapshot of metrics pushed by a responder instance
+type ResponderMetrics struct {
+	Route    string            `json:"route"`
+	Instance string            `json:"instance"`
+	Requests map[string]uint64 `json:"requests"`
+	Duration *histogram        `json:"duration"`
+	InFlight int64             `json:"in_flight"`
+	Errors   uint64            `json:"errors"`
+	received time.Time
+}
+
+// requestKey labels the request counter
+type requestKey struct {
+	route, method, class string
+}
+
+// natsErrorKey labels the NATS error counter
+type natsErrorKey struct {
+	route, kind string
+}
+
+// Metrics holds the acceptor's metrics and the latest metrics from each
+// responder instance
+type Metrics struct {
+	mutex      sync.Mutex
+	requests   map[requestKey]uint64
+	durations  map[string]*histogram
+	inFlight   map[string]int64
+	natsErrors map[natsErrorKey]uint64
+	responders map[string]*ResponderMetrics
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		requests:   make(map[requestKey]uint64),
+		durations:  make(map[string]*histogram),
+		inFlight:   make(map[string]int64),
+		natsErrors: make(map[natsErrorKey]uint64),
+		responders: make(map[string]*ResponderMetrics),
+	}
+}
+
+// the route as a metric label, requests that don't match a route in the
+// manifest are counted together so the labels don't grow with every path
+func routeLabel(route string) string {
+	if route == "" {
+		return "unmatched"
+	}
+	return route
+}
+
+// the status class of a response eg 2xx
+func statusClass(status int) string {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+// record a request that has been handled
+func (m *Metrics) observe(route, method string, status int, duration time.Duration) {
+	route = routeLabel(route)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.requests[requestKey{route, method, statusClass(status)}]++
+	h := m.durations[route]
+	if h == nil {
+		h = newHistogram()
+		m.durations[route] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// record a request starting or finishing on the route
+func (m *Metrics) begin(route string) {
+	m.mutex.Lock()
+	m.inFlight[routeLabel(route)]++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) done(route string) {
+	m.mutex.Lock()
+	m.inFlight[routeLabel(route)]--
+	m.mutex.Unlock()
+}
+
+// the number of requests being handled on all routes
+func (m *Metrics) active() (n int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, count := range m.inFlight {
+		n += count
+	}
+	return
+}
+
+// record a failure to get a reply from the responders over NATS
+func (m *Metrics) natsError(route string, err error) {
+	kind := "other"
+	switch err {
+	case nats.ErrTimeout:
+		kind = "timeout"
+	case nats.ErrNoResponders:
+		kind = "no_responders"
+	}
+	m.mutex.Lock()
+	m.natsErrors[natsErrorKey{routeLabel(route), kind}]++
+	m.mutex.Unlock()
+}
+
+// keep the metrics pushed by a responder instance
+func (m *Metrics) receive(msg *nats.Msg) {
+	rm := &ResponderMetrics{}
+	err := json.Unmarshal(msg.Data, rm)
+	if err != nil || rm.Instance == "" {
+		warning("Ignoring malformed responder metrics", err)
+		return
+	}
+	if rm.Duration == nil || len(rm.Duration.Counts) != len(buckets) {
+		rm.Duration = newHistogram()
+	}
+	rm.received = time.Now()
+	m.mutex.Lock()
+	m.responders[rm.Instance] = rm
+	m.mutex.Unlock()
+}
+
+// subscribe to the metrics pushed by the responders
+func collectMetrics() (err error) {
+	_, err = conn.Subscribe(metricsSubject, metrics.receive)
+	return
+}
+
+// write the metrics in the Prometheus text exposition format
+func (m *Metrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	header(w, "red_acceptor_requests_total", "counter", "Requests handled by the acceptor.")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.class < b.class
+	})
+	for _, k := range keys {
+		sample(w, "red_acceptor_requests_total", labels("route", k.route, "method", k.method, "status", k.class), float64(m.requests[k]))
+	}
+
+	header(w, "red_acceptor_request_duration_seconds", "histogram", "Time taken to handle requests.")
+	for _, route := range sortedKeys(m.durations) {
+		writeHistogram(w, "red_acceptor_request_duration_seconds", labels("route", route), m.durations[route])
+	}
+
+	header(w, "red_acceptor_requests_in_flight", "gauge", "Requests being handled by the acceptor.")
+	for _, route := range sortedKeys(m.inFlight) {
+		sample(w, "red_acceptor_requests_in_flight", labels("route", route), float64(m.inFlight[route]))
+	}
+
+	header(w, "red_acceptor_nats_errors_total", "counter", "Requests that got no reply from the responders.")
+	errKeys := make([]natsErrorKey, 0, len(m.natsErrors))
+	for k := range m.natsErrors {
+		errKeys = append(errKeys, k)
+	}
+	sort.Slice(errKeys, func(i, j int) bool {
+		if errKeys[i].route != errKeys[j].route {
+			return errKeys[i].route < errKeys[j].route
+		}
+		return errKeys[i].kind < errKeys[j].kind
+	})
+	for _, k := range errKeys {
+		sample(w, "red_acceptor_nats_errors_total", labels("route", k.route, "error", k.kind), float64(m.natsErrors[k]))
+	}
+
+	connected := 0.0
+	if connState() == "connected" {
+		connected = 1
+	}
+	header(w, "red_acceptor_nats_connected", "gauge", "Whether the acceptor is connected to the NATS server.")
+	sample(w, "red_acceptor_nats_connected", "", connected)
+	if conn != nil {
+		header(w, "red_acceptor_nats_reconnects_total", "counter", "Reconnections to the NATS server.")
+		sample(w, "red_acceptor_nats_reconnects_total", "", float64(conn.Stats().Reconnects))
+	}
+
+	// drop the responders that have stopped pushing their metrics
+	for instance, rm := range m.responders {
+		if time.Since(rm.received) > metricsExpiry {
+			delete(m.responders, instance)
+		}
+	}
+	instances := sortedKeys(m.responders)
+
+	header(w, "red_responder_requests_total", "counter", "Requests handled by each responder instance.")
+	for _, instance := range instances {
+		rm := m.responders[instance]
+		for _, class := range sortedKeys(rm.Requests) {
+			sample(w, "red_responder_requests_total", labels("route", rm.Route, "instance", instance, "status", class), float64(rm.Requests[class]))
+		}
+	}
+	header(w, "red_responder_handle_duration_seconds", "histogram", "Time taken by each responder instance to handle requests.")
+	for _, instance := range instances {
+		rm := m.responders[instance]
+		writeHistogram(w, "red_responder_handle_duration_seconds", labels("route", rm.Route, "instance", instance), rm.Duration)
+	}
+	header(w, "red_responder_requests_in_flight", "gauge", "Requests being handled by each responder instance.")
+	for _, instance := range instances {
+		rm := m.responders[instance]
+		sample(w, "red_responder_requests_in_flight", labels("route", rm.Route, "instance", instance), float64(rm.InFlight))
+	}
+	header(w, "red_responder_errors_total", "counter", "Requests each responder instance could not handle.")
+	for _, instance := range instances {
+		rm := m.responders[instance]
+		sample(w, "red_responder_errors_total", labels("route", rm.Route, "instance", instance), float64(rm.Errors))
+	}
+}
+
+func header(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sample(w io.Writer, name, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s %g\n", name, labels, value)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	for i, le := range buckets {
+		sample(w, name+"_bucket", labels+`,le="`+fmt.Sprint(le)+`"`, float64(h.Counts[i]))
+	}
+	sample(w, name+"_bucket", labels+`,le="+Inf"`, float64(h.Count))
+	sample(w, name+"_sum", labels, h.Sum)
+	sample(w, name+"_count", labels, float64(h.Count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// format label names and values as name="value",...
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedKeys[V any](m map[string]V) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// serve the metrics for Prometheus to scrape
+func serveMetrics(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.write(writer)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := newMetrics()
+	m.observe("GET/_/users/:id", "GET", http.StatusOK, 20*time.Millisecond)
+	m.observe("GET/_/users/:id", "GET", http.StatusNotFound, 2*time.Second)
+	m.observe("", "GET", http.StatusGatewayTimeout, time.Second)
+	m.begin("GET/_/users/:id")
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		`red_acceptor_requests_total{route="GET/_/users/:id",method="GET",status="2xx"} 1`,
+		`red_acceptor_requests_total{route="GET/_/users/:id",method="GET",status="4xx"} 1`,
+		`red_acceptor_requests_total{route="unmatched",method="GET",status="5xx"} 1`,
+		`red_acceptor_request_duration_seconds_bucket{route="GET/_/users/:id",le="0.025"} 1`,
+		`red_acceptor_request_duration_seconds_bucket{route="GET/_/users/:id",le="2.5"} 2`,
+		`red_acceptor_request_duration_seconds_bucket{route="GET/_/users/:id",le="+Inf"} 2`,
+		`red_acceptor_request_duration_seconds_count{route="GET/_/users/:id"} 2`,
+		`red_acceptor_requests_in_flight{route="GET/_/users/:id"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Error("missing", line)
+		}
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	got := labels("route", `a"b\c`)
+	if got != `route="a\"b\\c"` {
+		t.Error("wrong labels:", got)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sausheong/legion/trace"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// exchange holds what is learnt about a request while it's handled, so it
+// can be traced and recorded once the response is sent
+type exchange struct {
+	span            *trace.Span
+	route           string
+	label           string
+	requestId       string
+	responderStatus string
+}
+
+type exchangeKey struct{}
+
+// get the exchange for the request, handlers that aren't observed get an
+// exchange that isn't recorded
+func exchangeOf(request *http.Request) *exchange {
+	ex, ok := request.Context().Value(exchangeKey{}).(*exchange)
+	if !ok {
+		ex = &exchange{span: trace.StartSpan("unobserved", trace.Internal, "")}
+	}
+	return ex
+}
+
+// observe wraps a handler to trace, measure and log each request it handles
+func observe(handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, request *http.Request, p httprouter.Params) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: writer}
+		ex := &exchange{
+			span: trace.StartSpan("acceptor receive", trace.Server, request.Header.Get("traceparent")),
+		}
+		request = request.WithContext(context.WithValue(request.Context(), exchangeKey{}, ex))
+
+		handle(recorder, request, p)
+		duration := time.Since(start)
+		metrics.observe(ex.label, request.Method, recorder.status, duration)
+		// unmatched requests are timed together, as they are counted
+		if ex.route != "" {
+			publishTiming(routeLabel(ex.label), request.Method, recorder.status, start, duration)
+		}
+		accessLog.log(request, recorder, ex, start, duration)
+
+		ex.span.Set("http.method", request.Method)
+		ex.span.Set("http.target", request.URL.Path)
+		ex.span.Set("http.status_code", strconv.Itoa(recorder.status))
+		ex.span.Set("red.route", ex.route)
+		ex.span.Set("red.request_id", ex.requestId)
+		if recorder.status >= 500 {
+			ex.span.Fail(http.StatusText(recorder.status))
+		}
+		ex.span.End()
+	}
+}
+
+// timings are published for each request to this subject, for the control
+// plane's analytics
+const timingsSubject = "_red.timings"
+
+// Timing is how long a request to a route took and how it was answered
+type Timing struct {
+	Route    string  `json:"route"`
+	Method   string  `json:"method"`
+	Status   int     `json:"status"`
+	Time     int64   `json:"time"`
+	Duration float64 `json:"duration_ms"`
+}
+
+// publish the timing of a request
+func publishTiming(route, method string, status int, start time.Time, duration time.Duration) {
+	if conn == nil {
+		return
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	data, err := json.Marshal(Timing{
+		Route:    route,
+		Method:   method,
+		Status:   status,
+		Time:     start.Unix(),
+		Duration: float64(duration) / float64(time.Millisecond),
+	})
+	if err != nil {
+		danger("Cannot marshal timing", err)
+		return
+	}
+	err = conn.Publish(timingsSubject, data)
+	if err != nil {
+		warning("Cannot publish timing", err)
+	}
+}
+
+// responseRecorder keeps the status and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (n int, err error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err = r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// hijacked connections are WebSocket upgrades
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// let http.ResponseController reach the underlying writer
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// send the acceptor's spans to the control plane every second
+func exportSpans() {
+	resource := []trace.Attribute{trace.NewAttribute("service.name", "acceptor")}
+	scope := map[string]string{"name": "red", "version": version()}
+	trace.Setup(resource, scope, func(data []byte) {
+		err := conn.Publish(trace.Subject, data)
+		if err != nil {
+			warning("Cannot publish spans", err)
+		}
+	})
+	trace.Export()
+}
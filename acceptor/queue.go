@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats.go"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+)
+
+// the long-lived connection to the NATS server, shared by all requests
+var conn *nats.Conn
+
+// connect to the NATS server, retrying in the background if the server is
+// not up yet, and reconnecting with backoff whenever the connection drops
+// requests published while reconnecting are buffered and sent on reconnect
+func connect() (err error) {
+	url := os.Getenv("QUEUE")
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	conn, err = nats.Connect(url,
+		nats.Name("red acceptor"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(backoff),
+		nats.ReconnectBufSize(8<<20),
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			warning("Disconnected from NATS server", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			info("Reconnected to NATS server at", c.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(c *nats.Conn) {
+			info("Connection to NATS server closed")
+		}),
+	)
+	return
+}
+
+// exponential backoff with jitter, starting at 100ms and capped at 5s
+func backoff(attempts int) time.Duration {
+	if attempts > 6 {
+		attempts = 6
+	}
+	wait := 100 * time.Millisecond << uint(attempts)
+	if wait > 5*time.Second {
+		wait = 5 * time.Second
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)))
+}
+
+// describe the state of the NATS connection
+func connState() string {
+	if conn == nil {
+		return "disconnected"
+	}
+	switch conn.Status() {
+	case nats.CONNECTED:
+		return "connected"
+	case nats.CONNECTING:
+		return "connecting"
+	case nats.RECONNECTING:
+		return "reconnecting"
+	case nats.DRAINING_SUBS, nats.DRAINING_PUBS:
+		return "draining"
+	case nats.CLOSED:
+		return "closed"
+	default:
+		return "disconnected"
+	}
+}
+
+// health check for the acceptor, returns 503 if NATS is not connected
+func health(writer http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	state := connState()
+	status := http.StatusOK
+	if state != "connected" {
+		status = http.StatusServiceUnavailable
+	}
+	data := map[string]interface{}{
+		"version": version(),
+		"nats":    state,
+	}
+	if conn != nil {
+		data["reconnects"] = conn.Stats().Reconnects
+		data["server"] = conn.ConnectedUrl()
+	}
+	body, _ := json.Marshal(data)
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	reply(writer, status, body)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the manifest is read from the responder's copy of the repository
+var manifestFile = "../responder/repo/responders.manifest"
+
+// Manifest is the part of the responders manifest the acceptor cares about
+type Manifest struct {
+	Errors map[string]string `json:"errors"`
+	Groups []struct {
+		Language   string `json:"language"`
+		Responders []struct {
+			ID             string   `json:"id"`
+			Path           string   `json:"path"`
+			Routes         []string `json:"routes"`
+			Timeout        string   `json:"timeout"`
+			MaxBody        int64    `json:"max_body"`
+			MaxConcurrency int      `json:"max_concurrency"`
+			Type           string   `json:"type"`
+			Stream         string   `json:"stream"`
+		} `json:"responders"`
+	} `json:"routes"`
+}
+
+// limits for routes that don't declare their own in the manifest
+const (
+	defaultTimeout = 1 * time.Second
+	defaultMaxBody = 10 << 20
+)
+
+// methods routed to the responders, HEAD and OPTIONS are answered by the
+// acceptor unless the manifest has routes for them
+var methods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// segment kinds, in order of precedence when more than one route matches
+const (
+	staticSegment = iota
+	paramSegment
+	wildcardSegment
+)
+
+// Route is a route pattern from the manifest, eg GET/_/users/:id
+// the route ID is also the NATS subject the responders subscribe to
+// the type is empty for request/response routes, websocket or sse
+// SSE routes relay the events published to their stream, which is named
+// after the route ID unless the manifest gives it a name
+type Route struct {
+	ID             string
+	Method         string
+	Pattern        string
+	Type           string
+	Stream         string
+	Timeout        time.Duration
+	MaxBody        int64
+	MaxConcurrency int
+	fallback       bool
+	segments       []string
+	kinds          []int
+	slots          chan struct{}
+}
+
+// RouteTable holds all the routes known to the acceptor
+type RouteTable struct {
+	mutex  sync.RWMutex
+	routes []*Route
+}
+
+var routes = &RouteTable{}
+
+// parse a route ID of the form METHOD/path/to/route into a Route
+func newRoute(id string) (route *Route, ok bool) {
+	i := strings.Index(id, "/")
+	if i < 1 {
+		return
+	}
+	route = &Route{
+		ID:      id,
+		Method:  id[:i],
+		Pattern: id[i:],
+		Timeout: defaultTimeout,
+		MaxBody: defaultMaxBody,
+	}
+	route.segments = splitPath(route.Pattern)
+	for n, s := range route.segments {
+		switch {
+		case strings.HasPrefix(s, ":"):
+			route.kinds = append(route.kinds, paramSegment)
+		case strings.HasPrefix(s, "*"):
+			// catch-all segments are only allowed at the end
+			if n != len(route.segments)-1 {
+				return nil, false
+			}
+			route.kinds = append(route.kinds, wildcardSegment)
+		default:
+			route.kinds = append(route.kinds, staticSegment)
+		}
+	}
+	ok = true
+	return
+}
+
+// a route for requests that don't match any route in the manifest, the
+// subject is the method and path eg GET/_/path, with the default limits
+func defaultRoute(method, path string) *Route {
+	return &Route{
+		ID:       method + path,
+		Method:   method,
+		Pattern:  path,
+		Timeout:  defaultTimeout,
+		MaxBody:  defaultMaxBody,
+		fallback: true,
+	}
+}
+
+// set the limits for the route, zero values keep the defaults
+func (route *Route) setLimits(timeout string, maxBody int64, maxConcurrency int) {
+	if timeout != "" {
+		t, err := time.ParseDuration(timeout)
+		if err != nil || t <= 0 {
+			warning("Ignoring invalid timeout for route", route.ID, timeout)
+		} else {
+			route.Timeout = t
+		}
+	}
+	if maxBody > 0 {
+		route.MaxBody = maxBody
+	}
+	if maxConcurrency > 0 {
+		route.MaxConcurrency = maxConcurrency
+		route.slots = make(chan struct{}, maxConcurrency)
+	}
+}
+
+// take a slot to handle a request on the route, returns false if the route
+// is already handling its maximum number of concurrent requests
+func (route *Route) acquire() bool {
+	if route.slots == nil {
+		return true
+	}
+	select {
+	case route.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// give back the slot taken by acquire
+func (route *Route) release() {
+	if route.slots != nil {
+		<-route.slots
+	}
+}
+
+// split a path into its segments, ignoring the leading and trailing slashes
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// match the route against a path, returning the captured path parameters
+func (route *Route) match(path string) (params map[string]string, ok bool) {
+	segments := splitPath(path)
+	params = make(map[string]string)
+	for i, s := range route.segments {
+		switch route.kinds[i] {
+		case wildcardSegment:
+			params[s[1:]] = strings.Join(segments[i:], "/")
+			return params, true
+		case paramSegment:
+			if i >= len(segments) || segments[i] == "" {
+				return nil, false
+			}
+			params[s[1:]] = segments[i]
+		default:
+			if i >= len(segments) || segments[i] != s {
+				return nil, false
+			}
+		}
+	}
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// check if this route should be preferred over another route that also
+// matches, static segments win over parameters, which win over catch-alls
+func (route *Route) precedes(other *Route) bool {
+	for i := 0; i < len(route.kinds) && i < len(other.kinds); i++ {
+		if route.kinds[i] != other.kinds[i] {
+			return route.kinds[i] < other.kinds[i]
+		}
+	}
+	return len(route.kinds) > len(other.kinds)
+}
+
+// Match finds the route for the given method and path
+func (table *RouteTable) Match(method, path string) (route *Route, params map[string]string) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	for _, r := range table.routes {
+		if r.Method != method {
+			continue
+		}
+		p, ok := r.match(path)
+		if ok && (route == nil || r.precedes(route)) {
+			route, params = r, p
+		}
+	}
+	return
+}
+
+// Methods lists the methods allowed on the path, for the Allow header
+func (table *RouteTable) Methods(path string) (allowed []string) {
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	found := make(map[string]bool)
+	for _, r := range table.routes {
+		if _, ok := r.match(path); ok {
+			found[r.Method] = true
+		}
+	}
+	if len(found) == 0 {
+		return
+	}
+	if found["GET"] {
+		found["HEAD"] = true
+	}
+	found["OPTIONS"] = true
+	for method := range found {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	return
+}
+
+// Set replaces all the routes in the table
+func (table *RouteTable) Set(rs []*Route) {
+	table.mutex.Lock()
+	table.routes = rs
+	table.mutex.Unlock()
+}
+
+// load the routes from the manifest file into the route table
+func loadRoutes(filename string) (err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	manifest := Manifest{}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return
+	}
+	var rs []*Route
+	for _, group := range manifest.Groups {
+		for _, r := range group.Responders {
+			// a responder built with a router handles all the routes it
+			// lists, otherwise its ID is the route
+			ids := r.Routes
+			if len(ids) == 0 {
+				ids = []string{r.ID}
+			}
+			for _, id := range ids {
+				route, ok := newRoute(id)
+				if !ok {
+					warning("Ignoring invalid route", id)
+					continue
+				}
+				route.setLimits(r.Timeout, r.MaxBody, r.MaxConcurrency)
+				route.Type = r.Type
+				route.Stream = r.Stream
+				if route.Stream == "" {
+					route.Stream = route.ID
+				}
+				rs = append(rs, route)
+			}
+		}
+	}
+	routes.Set(rs)
+	loadErrorPages(manifest.Errors)
+	info("Loaded", len(rs), "routes from", filename)
+	return
+}
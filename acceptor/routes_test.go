@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRoutes(t *testing.T, ids ...string) {
+	var rs []*Route
+	for _, id := range ids {
+		route, ok := newRoute(id)
+		if !ok {
+			t.Fatal("cannot parse route:", id)
+		}
+		rs = append(rs, route)
+	}
+	routes.Set(rs)
+}
+
+func TestMatchPathParams(t *testing.T) {
+	testRoutes(t, "GET/_/users/:id", "GET/_/users/:id/posts/:post")
+	route, params := routes.Match("GET", "/_/users/42/posts/7")
+	if route == nil || route.ID != "GET/_/users/:id/posts/:post" {
+		t.Fatal("wrong route:", route)
+	}
+	if params["id"] != "42" || params["post"] != "7" {
+		t.Error("wrong params:", params)
+	}
+	route, _ = routes.Match("POST", "/_/users/42")
+	if route != nil {
+		t.Error("matched route with the wrong method:", route.ID)
+	}
+	route, _ = routes.Match("GET", "/_/users")
+	if route != nil {
+		t.Error("matched route with a missing param:", route.ID)
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	testRoutes(t, "GET/_/files/*rest")
+	route, params := routes.Match("GET", "/_/files/a/b/c.txt")
+	if route == nil {
+		t.Fatal("no route matched")
+	}
+	if params["rest"] != "a/b/c.txt" {
+		t.Error("wrong params:", params)
+	}
+}
+
+func TestMatchPrecedence(t *testing.T) {
+	testRoutes(t, "GET/_/users/*rest", "GET/_/users/:id", "GET/_/users/me")
+	cases := map[string]string{
+		"/_/users/me":    "GET/_/users/me",
+		"/_/users/42":    "GET/_/users/:id",
+		"/_/users/42/ab": "GET/_/users/*rest",
+	}
+	for path, id := range cases {
+		route, _ := routes.Match("GET", path)
+		if route == nil || route.ID != id {
+			t.Error(path, "should match", id, "got", route)
+		}
+	}
+}
+
+func TestInvalidRoute(t *testing.T) {
+	if _, ok := newRoute("GET/_/*rest/more"); ok {
+		t.Error("catch-all must be the last segment")
+	}
+	if _, ok := newRoute("/_/no/method"); ok {
+		t.Error("route must start with a method")
+	}
+}
+
+func TestMethods(t *testing.T) {
+	testRoutes(t, "GET/_/users/:id", "DELETE/_/users/:id", "POST/_/users")
+	allowed := strings.Join(routes.Methods("/_/users/42"), ", ")
+	if allowed != "DELETE, GET, HEAD, OPTIONS" {
+		t.Error("wrong methods:", allowed)
+	}
+	if allowed := routes.Methods("/_/unknown"); len(allowed) != 0 {
+		t.Error("methods for unknown path:", allowed)
+	}
+}
+
+func TestLoadRouterRoutes(t *testing.T) {
+	manifest := filepath.Join(t.TempDir(), "responders.manifest")
+	err := os.WriteFile(manifest, []byte(`{"routes": [{"language": "go", "responders": [
+		{"id": "api", "path": "api.go", "timeout": "3s", "routes": ["GET/_/users/:id", "POST/_/users"]},
+		{"id": "GET/_/hello", "path": "hello.go"}
+	]}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadRoutes(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, id := range map[string]string{"/_/users/42": "GET/_/users/:id", "/_/hello": "GET/_/hello"} {
+		route, _ := routes.Match("GET", path)
+		if route == nil || route.ID != id {
+			t.Error(path, "should match", id, "got", route)
+		}
+	}
+	route, _ := routes.Match("POST", "/_/users")
+	if route == nil || route.Timeout != 3*time.Second {
+		t.Error("router routes should share the responder's limits:", route)
+	}
+	if route, _ := routes.Match("GET", "/_/api"); route != nil {
+		t.Error("responder ID should not be a route when it lists routes")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sausheong/legion/trace"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// how long to wait for outstanding requests to finish when shutting down,
+// unless the SHUTDOWN_TIMEOUT environment variable sets another duration
+const defaultShutdownTimeout = 30 * time.Second
+
+// closed when the acceptor starts shutting down, so long-lived connections
+// like WebSockets and event streams can be closed
+var closing = make(chan struct{})
+
+func shutdownTimeout() time.Duration {
+	if t := os.Getenv("SHUTDOWN_TIMEOUT"); t != "" {
+		timeout, err := time.ParseDuration(t)
+		if err == nil && timeout > 0 {
+			return timeout
+		}
+		warning("Ignoring invalid shutdown timeout", t)
+	}
+	return defaultShutdownTimeout
+}
+
+// wait for SIGTERM or SIGINT, then stop accepting connections, let the
+// outstanding requests finish up to the deadline and close the connection
+// to the NATS server
+func waitForShutdown(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	signal.Stop(signals)
+
+	timeout := shutdownTimeout()
+	info("Received", sig, "- shutting down, waiting up to", timeout, "for", metrics.active(), "requests")
+	fmt.Println("Polyglot Acceptor shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// report progress while waiting
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				info("Waiting for", metrics.active(), "requests to finish")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// closing the listeners stops new connections, and idle connections
+	// are closed as their requests finish
+	server.RegisterOnShutdown(func() { close(closing) })
+	err := server.Shutdown(ctx)
+	if err != nil {
+		warning("Shutdown deadline passed with requests still open", err)
+	}
+	// hijacked connections aren't tracked by the server, so wait for
+	// the WebSockets to close too
+	for metrics.active() > 0 && ctx.Err() == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := metrics.active(); n > 0 {
+		warning("Abandoning", n, "requests")
+	} else {
+		info("All requests finished")
+	}
+
+	// send what's left of the traces, then drain the subscriptions and
+	// flush anything still buffered before the connection is closed
+	trace.Flush()
+	if conn != nil {
+		err = conn.Drain()
+		if err != nil {
+			warning("Cannot drain NATS connection", err)
+			conn.Close()
+		}
+		for !conn.IsClosed() && ctx.Err() == nil {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if !conn.IsClosed() {
+			conn.Close()
+		}
+	}
+	if accessLog != nil {
+		accessLog.out.Close()
+	}
+	info("Acceptor stopped")
+	fmt.Println("Polyglot Acceptor stopped")
+}
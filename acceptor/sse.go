@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many recent events each stream keeps for clients resuming with
+// Last-Event-ID, and how often to send a comment to keep connections open
+const (
+	historySize       = 100
+	heartbeatInterval = 15 * time.Second
+)
+
+// ServerEvent is an event published by responders to a stream
+type ServerEvent struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Data  string `json:"data"`
+	Retry int    `json:"retry"`
+}
+
+// hub relays the events on a stream's subject to all its clients
+type hub struct {
+	mutex   sync.Mutex
+	subject string
+	seq     int64
+	history []ServerEvent
+	clients map[chan ServerEvent]bool
+}
+
+var hubs = struct {
+	sync.Mutex
+	streams map[string]*hub
+}{streams: make(map[string]*hub)}
+
+// the subject responders publish a stream's events to
+func streamSubject(stream string) string {
+	return "_red.sse." + stream
+}
+
+// get the hub for the stream, subscribing to its subject the first time
+// hubs are kept once created so the history is there for later clients
+func getHub(stream string) (h *hub, err error) {
+	hubs.Lock()
+	defer hubs.Unlock()
+	h = hubs.streams[stream]
+	if h != nil {
+		return
+	}
+	h = &hub{
+		subject: streamSubject(stream),
+		clients: make(map[chan ServerEvent]bool),
+	}
+	_, err = conn.Subscribe(h.subject, h.receive)
+	if err != nil {
+		return nil, err
+	}
+	hubs.streams[stream] = h
+	return
+}
+
+// receive an event from NATS and send it to every client
+func (h *hub) receive(msg *nats.Msg) {
+	event := ServerEvent{}
+	err := json.Unmarshal(msg.Data, &event)
+	if err != nil {
+		danger("Malformed event on", h.subject, err)
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.seq++
+	if event.ID == "" {
+		event.ID = strconv.FormatInt(h.seq, 10)
+	}
+	h.history = append(h.history, event)
+	if len(h.history) > historySize {
+		h.history = h.history[len(h.history)-historySize:]
+	}
+	for client := range h.clients {
+		select {
+		case client <- event:
+		default:
+			// the client is too slow to keep up, drop it
+			delete(h.clients, client)
+			close(client)
+		}
+	}
+}
+
+// add a client, returning the events it missed since the last event ID
+func (h *hub) join(lastEventId string) (client chan ServerEvent, missed []ServerEvent) {
+	client = make(chan ServerEvent, 64)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.clients[client] = true
+	if lastEventId != "" {
+		for i, event := range h.history {
+			if event.ID == lastEventId {
+				missed = append(missed, h.history[i+1:]...)
+				break
+			}
+		}
+	}
+	return
+}
+
+// remove a client
+func (h *hub) leave(client chan ServerEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.clients[client] {
+		delete(h.clients, client)
+		close(client)
+	}
+}
+
+// write an event in the text/event-stream format
+func writeEvent(writer http.ResponseWriter, event ServerEvent) (err error) {
+	var b strings.Builder
+	if event.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", event.ID)
+	}
+	if event.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event.Event)
+	}
+	if event.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", event.Retry)
+	}
+	for _, line := range strings.Split(event.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err = writer.Write([]byte(b.String()))
+	return
+}
+
+// hold the connection open and relay the stream's events to the client
+func events(writer http.ResponseWriter, request *http.Request, route *Route) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		fail(writer, request, route.ID, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	h, err := getHub(route.Stream)
+	if err != nil {
+		danger("Cannot subscribe to stream", route.Stream, err)
+		fail(writer, request, route.ID, http.StatusServiceUnavailable, "Cannot subscribe to stream")
+		return
+	}
+	lastEventId := request.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = request.URL.Query().Get("lastEventId")
+	}
+	client, missed := h.join(lastEventId)
+	defer h.leave(client)
+
+	// the connection stays open for as long as the client wants
+	http.NewResponseController(writer).SetWriteDeadline(time.Time{})
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	for _, event := range missed {
+		writeEvent(writer, event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, open := <-client:
+			if !open {
+				return
+			}
+			err = writeEvent(writer, event)
+		case <-heartbeat.C:
+			_, err = writer.Write([]byte(": ping\n\n"))
+		case <-request.Context().Done():
+			return
+		case <-closing:
+			// clients reconnect with the last event ID they got
+			return
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
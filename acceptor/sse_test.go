@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"net/http/httptest"
+	"testing"
+)
+
+func testEvent(t *testing.T, h *hub, event ServerEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.receive(&nats.Msg{Data: data})
+}
+
+func TestHubResume(t *testing.T) {
+	h := &hub{clients: make(map[chan ServerEvent]bool)}
+	testEvent(t, h, ServerEvent{Data: "one"})
+	testEvent(t, h, ServerEvent{Data: "two"})
+	testEvent(t, h, ServerEvent{Data: "three"})
+
+	client, missed := h.join("1")
+	defer h.leave(client)
+	if len(missed) != 2 || missed[0].Data != "two" || missed[1].ID != "3" {
+		t.Error("wrong missed events:", missed)
+	}
+
+	testEvent(t, h, ServerEvent{ID: "custom", Data: "four"})
+	event := <-client
+	if event.ID != "custom" || event.Data != "four" {
+		t.Error("wrong event:", event)
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeEvent(recorder, ServerEvent{ID: "7", Event: "update", Data: "a\nb"})
+	expected := "id: 7\nevent: update\ndata: a\ndata: b\n\n"
+	if recorder.Body.String() != expected {
+		t.Errorf("wrong event format: %q", recorder.Body.String())
+	}
+}
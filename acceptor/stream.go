@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"time"
+)
+
+// acknowledgements sent back to streaming responders for each chunk
+// the responder waits for the ack before sending the next chunk
+var (
+	ackContinue = []byte("ok")
+	ackCancel   = []byte("cancel")
+)
+
+// relay the chunks of a streamed response to the client as they arrive,
+// the responder sends them to the subscription's subject once it has it
+// the route timeout applies to the wait for each chunk, not the whole body
+func stream(writer http.ResponseWriter, request *http.Request, sub *nats.Subscription, route *Route, status int) {
+	requestId := writer.Header().Get(requestIDHeader)
+	// the body can take much longer than the route timeout to send
+	http.NewResponseController(writer).SetWriteDeadline(time.Time{})
+	writer.WriteHeader(status)
+	flusher, _ := writer.(http.Flusher)
+
+	for {
+		msg, err := sub.NextMsg(route.Timeout)
+		if err != nil {
+			danger("Stream from responder stopped", route.ID, requestId, err)
+			return
+		}
+		chunk := Chunk{}
+		err = json.Unmarshal(msg.Data, &chunk)
+		if err != nil {
+			danger("Malformed chunk from responder", route.ID, requestId, err)
+			msg.Respond(ackCancel)
+			return
+		}
+		if chunk.Error != "" {
+			danger("Responder failed while streaming", route.ID, requestId, chunk.Error)
+		}
+		data, err := base64.StdEncoding.DecodeString(chunk.Data)
+		if err != nil {
+			danger("Cannot decode chunk from responder", route.ID, requestId, err)
+			msg.Respond(ackCancel)
+			return
+		}
+		// HEAD requests only need the headers, stop the responder
+		if request.Method == "HEAD" {
+			msg.Respond(ackCancel)
+			return
+		}
+		if len(data) > 0 {
+			_, err = writer.Write(data)
+			if err != nil {
+				warning("Client went away during stream", route.ID, requestId, err)
+				msg.Respond(ackCancel)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		msg.Respond(ackContinue)
+		if chunk.End {
+			return
+		}
+	}
+}
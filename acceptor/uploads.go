@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// uploaded files are spooled to a directory shared with the responders
+var uploadDir = "../responder/uploads"
+
+// create the upload directory and make its path absolute, since the
+// responders run from a different directory
+func setupUploads() (err error) {
+	uploadDir, err = filepath.Abs(uploadDir)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(uploadDir, 0755)
+	return
+}
+
+// read a multipart request part by part, writing each uploaded file to the
+// upload directory as it arrives and adding the form fields to params
+// the paths of all spooled files are returned so they can be removed, even
+// if reading the request fails part of the way
+func spool(request *http.Request, params map[string][]string) (multipart map[string][]Multipart, files []string, err error) {
+	multipart = make(map[string][]Multipart)
+	reader, err := request.MultipartReader()
+	if err != nil {
+		return
+	}
+	for {
+		part, e := reader.NextPart()
+		if e == io.EOF {
+			return
+		}
+		if e != nil {
+			err = e
+			return
+		}
+		name := part.FormName()
+		if part.FileName() == "" {
+			value, e := ioutil.ReadAll(part)
+			if e != nil {
+				err = e
+				return
+			}
+			params[name] = append(params[name], string(value))
+			continue
+		}
+
+		file, e := ioutil.TempFile(uploadDir, "upload-")
+		if e != nil {
+			err = e
+			return
+		}
+		files = append(files, file.Name())
+		size, e := io.Copy(file, part)
+		file.Close()
+		if e != nil {
+			err = e
+			return
+		}
+		multipart[name] = append(multipart[name], Multipart{
+			Filename:    part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+			Size:        size,
+			Path:        file.Name(),
+		})
+	}
+}
+
+// remove spooled files once the request is done
+func removeUploads(files []string) {
+	for _, f := range files {
+		err := os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			warning("Cannot remove upload", f, err)
+		}
+	}
+}
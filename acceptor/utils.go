@@ -3,8 +3,8 @@ package main
 import (
 	"crypto/rand"
 	"fmt"
-	"io"
 	"log"
+	"net/http"
 	"os"
 )
 
@@ -15,20 +15,29 @@ type RequestInfo struct {
 	URL              URLInfo                `json:"URL"`
 	Proto            string                 `json:"Proto"`
 	Header           map[string][]string    `json:"Header"`
-	Body             io.ReadCloser          `json:"Body"`
+	Body             string                 `json:"Body"`
+	BodyEncoding     string                 `json:"BodyEncoding"`
 	ContentLength    int64                  `json:"ContentLength"`
 	TransferEncoding []string               `json:"TransferEncoding"`
 	Host             string                 `json:"Host"`
 	Params           map[string][]string    `json:"Params"`
+	PathParams       map[string]string      `json:"PathParams"`
 	Multipart        map[string][]Multipart `json:"Multipart"`
 	RemoteAddr       string                 `json:"RemoteAddr"`
 	RequestURI       string                 `json:"RequestURI"`
+	RequestID        string                 `json:"RequestID"`
+	TraceParent      string                 `json:"TraceParent"`
+	// how long the acceptor waits for the reply, in milliseconds
+	Timeout int64 `json:"Timeout"`
 }
 
+// Multipart is an uploaded file, spooled to the upload directory
+// the path is absolute so responders can open it from any directory
 type Multipart struct {
 	Filename    string `json:"Filename"`
 	ContentType string `json:"ContentType"`
-	Content     string `json:"Content"`
+	Size        int64  `json:"Size"`
+	Path        string `json:"Path"`
 }
 
 type URLInfo struct {
@@ -41,9 +50,18 @@ type URLInfo struct {
 }
 
 type ResponseInfo struct {
-	Status string              `json:"status"`
-	Header map[string][]string `json:"header"`
-	Body   string              `json:"body"`
+	Status   string              `json:"status"`
+	Header   map[string][]string `json:"header"`
+	Body     string              `json:"body"`
+	Encoding string              `json:"encoding"`
+	Stream   bool                `json:"stream"`
+}
+
+// Chunk is a piece of a streamed response body
+type Chunk struct {
+	Data  string `json:"data"`
+	End   bool   `json:"end"`
+	Error string `json:"error,omitempty"`
 }
 
 func init() {
@@ -59,7 +77,9 @@ func init() {
 func createUUID() (uuid string) {
 	u := new([16]byte)
 	_, err := rand.Read(u[:])
-	danger("Cannot generate UUID", err)
+	if err != nil {
+		danger("Cannot generate UUID", err)
+	}
 	// 0x40 is reserved variant from RFC 4122
 	u[8] = (u[8] | 0x40) & 0x7F
 	// Set the four most significant bits (bits 12 through 15) of the
@@ -69,6 +89,34 @@ func createUUID() (uuid string) {
 	return
 }
 
+// the header carrying the request ID between clients and the acceptor
+const requestIDHeader = "X-Request-Id"
+
+// use the client's request ID if it sent a sensible one, or create one,
+// and set it on the response
+func setRequestID(writer http.ResponseWriter, request *http.Request) (id string) {
+	id = request.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = createUUID()
+	}
+	writer.Header().Set(requestIDHeader, id)
+	return
+}
+
+// request IDs from clients end up in logs, so only accept short IDs made
+// of printable characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 // for logging
 
 func info(args ...interface{}) {
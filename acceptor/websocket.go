@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how often to ping WebSocket clients, and how long to wait for the pong
+const (
+	pingPeriod = 30 * time.Second
+	pongWait   = 60 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// SocketEvent is published to the route's subject for every connect,
+// message and close on a WebSocket connection
+type SocketEvent struct {
+	Type     string       `json:"type"`
+	ConnID   string       `json:"conn_id"`
+	Route    string       `json:"route"`
+	Data     string       `json:"data,omitempty"`
+	Encoding string       `json:"encoding,omitempty"`
+	Request  *RequestInfo `json:"request,omitempty"`
+}
+
+// SocketFrame is sent by responders to a connection's subject to push a
+// message to the client, or to close the connection
+type SocketFrame struct {
+	Data     string `json:"data"`
+	Encoding string `json:"encoding"`
+	Close    bool   `json:"close"`
+}
+
+// the subject responders publish frames to for a connection
+func socketSubject(connId string) string {
+	return "_red.ws." + connId
+}
+
+// upgrade the request to a WebSocket and bridge it to the route's
+// responders until either side closes the connection
+func socket(writer http.ResponseWriter, request *http.Request, route *Route, pathParams map[string]string) {
+	ws, err := upgrader.Upgrade(writer, request, writer.Header())
+	if err != nil {
+		// the upgrader has already replied to the client
+		warning("Cannot upgrade to WebSocket", route.ID, err)
+		return
+	}
+	defer ws.Close()
+	// the server's deadlines don't apply once the connection is upgraded
+	ws.SetWriteDeadline(time.Time{})
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		ws.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	connId := createUUID()
+	reqInfo := newRequestInfo(request, route.Method, request.URL.Query(), pathParams)
+	reqInfo.RequestID = writer.Header().Get(requestIDHeader)
+	publish := func(event SocketEvent) {
+		event.ConnID, event.Route = connId, route.ID
+		data, err := json.Marshal(event)
+		if err != nil {
+			danger("Cannot marshal socket event", err)
+			return
+		}
+		err = conn.Publish(route.ID, data)
+		if err != nil {
+			danger("Cannot publish socket event", route.ID, err)
+		}
+	}
+
+	// frames from responders are written to the client, one at a time
+	var mutex sync.Mutex
+	write := func(messageType int, data []byte) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return ws.WriteMessage(messageType, data)
+	}
+	sub, err := conn.Subscribe(socketSubject(connId), func(msg *nats.Msg) {
+		frame := SocketFrame{}
+		err := json.Unmarshal(msg.Data, &frame)
+		if err != nil {
+			danger("Malformed socket frame", connId, err)
+			return
+		}
+		if frame.Close {
+			write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			ws.Close()
+			return
+		}
+		data, err := decodeBody(frame.Data, frame.Encoding, "")
+		if err != nil {
+			danger("Cannot decode socket frame", connId, err)
+			return
+		}
+		messageType := websocket.TextMessage
+		if frame.Encoding == "base64" {
+			messageType = websocket.BinaryMessage
+		}
+		err = write(messageType, data)
+		if err != nil {
+			warning("Cannot write to WebSocket", connId, err)
+		}
+	})
+	if err != nil {
+		danger("Cannot subscribe to socket subject", connId, err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	// keep the connection alive and detect clients that went away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if write(websocket.PingMessage, nil) != nil {
+					return
+				}
+			case <-closing:
+				write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+				ws.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	info("WebSocket connected", route.ID, connId)
+	publish(SocketEvent{Type: "connect", Request: &reqInfo})
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			break
+		}
+		// binary messages are always base64 encoded so responders can
+		// tell them apart from text messages
+		event := SocketEvent{Type: "message", Data: string(data), Encoding: "text"}
+		if messageType == websocket.BinaryMessage {
+			event.Data = base64.StdEncoding.EncodeToString(data)
+			event.Encoding = "base64"
+		}
+		publish(event)
+	}
+	publish(SocketEvent{Type: "close"})
+	info("WebSocket closed", route.ID, connId)
+}
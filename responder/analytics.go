@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the acceptor publishes the timing of each request to this subject
+const timingsSubject = "_red.timings"
+
+// timings are kept in per-minute buckets for this long, unless the
+// ANALYTICS_WINDOW environment variable sets another duration eg 6h
+const defaultAnalyticsWindow = 24 * time.Hour
+
+// Timing is how long a request to a route took and how it was answered
+type Timing struct {
+	Route    string  `json:"route"`
+	Method   string  `json:"method"`
+	Status   int     `json:"status"`
+	Time     int64   `json:"time"`
+	Duration float64 `json:"duration_ms"`
+}
+
+// the requests to a route in a minute
+type minuteBucket struct {
+	count    int
+	totalMs  float64
+	statuses map[int]int
+}
+
+// TimeSeries keeps per-minute request counts, response times and status
+// codes for each route, for the analytics window
+type TimeSeries struct {
+	mutex  sync.Mutex
+	window time.Duration
+	routes map[string]map[int64]*minuteBucket
+}
+
+var analytics = newTimeSeries(defaultAnalyticsWindow)
+
+func newTimeSeries(window time.Duration) *TimeSeries {
+	return &TimeSeries{
+		window: window,
+		routes: make(map[string]map[int64]*minuteBucket),
+	}
+}
+
+func analyticsWindow() time.Duration {
+	if w := os.Getenv("ANALYTICS_WINDOW"); w != "" {
+		window, err := time.ParseDuration(w)
+		if err == nil && window >= time.Minute {
+			return window
+		}
+		warning("Ignoring invalid analytics window", w)
+	}
+	return defaultAnalyticsWindow
+}
+
+// add the timing of a request to its minute
+func (ts *TimeSeries) add(t Timing) {
+	minute := t.Time / 60
+	if time.Since(time.Unix(minute*60, 0)) > ts.window {
+		return
+	}
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	minutes := ts.routes[t.Route]
+	if minutes == nil {
+		minutes = make(map[int64]*minuteBucket)
+		ts.routes[t.Route] = minutes
+	}
+	b := minutes[minute]
+	if b == nil {
+		b = &minuteBucket{statuses: make(map[int]int)}
+		minutes[minute] = b
+	}
+	b.count++
+	b.totalMs += t.Duration
+	b.statuses[t.Status]++
+}
+
+// drop the buckets that have fallen out of the window
+func (ts *TimeSeries) prune(now time.Time) {
+	oldest := now.Add(-ts.window).Unix() / 60
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	for route, minutes := range ts.routes {
+		for minute := range minutes {
+			if minute < oldest {
+				delete(minutes, minute)
+			}
+		}
+		if len(minutes) == 0 {
+			delete(ts.routes, route)
+		}
+	}
+}
+
+// Bin is the requests to a route over a stretch of the window
+type Bin struct {
+	Start time.Time
+	Count int
+	AvgMs float64
+}
+
+// StatusCount is the number of responses with a status code
+type StatusCount struct {
+	Status int
+	Count  int
+	Share  float64
+}
+
+// the class of the status for display eg success or danger
+func (s StatusCount) Class() string {
+	switch {
+	case s.Status >= 500:
+		return "danger"
+	case s.Status >= 400:
+		return "warning"
+	case s.Status >= 300:
+		return "info"
+	default:
+		return "success"
+	}
+}
+
+// group the routes' buckets into n bins across the window ending now, and
+// total up the status codes
+func (ts *TimeSeries) series(routes []string, n int, now time.Time) (bins []Bin, statuses []StatusCount) {
+	step := ts.window / time.Duration(n)
+	start := now.Add(-ts.window)
+	bins = make([]Bin, n)
+	totals := make([]float64, n)
+	for i := range bins {
+		bins[i].Start = start.Add(step * time.Duration(i))
+	}
+	counts := make(map[int]int)
+	ts.mutex.Lock()
+	for _, route := range routes {
+		for minute, b := range ts.routes[route] {
+			i := int(time.Unix(minute*60, 0).Sub(start) / step)
+			if i < 0 || i >= n {
+				continue
+			}
+			bins[i].Count += b.count
+			totals[i] += b.totalMs
+			for status, count := range b.statuses {
+				counts[status] += count
+			}
+		}
+	}
+	ts.mutex.Unlock()
+	for i := range bins {
+		if bins[i].Count > 0 {
+			bins[i].AvgMs = totals[i] / float64(bins[i].Count)
+		}
+	}
+	for status, count := range counts {
+		statuses = append(statuses, StatusCount{Status: status, Count: count})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Status < statuses[j].Status })
+	return
+}
+
+// collect the timings published by the acceptor
+func collectTimings() (err error) {
+	analytics.window = analyticsWindow()
+	_, err = conn.Subscribe(timingsSubject, func(msg *nats.Msg) {
+		t := Timing{}
+		if json.Unmarshal(msg.Data, &t) != nil || t.Route == "" {
+			return
+		}
+		analytics.add(t)
+	})
+	if err != nil {
+		return
+	}
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			analytics.prune(now)
+		}
+	}()
+	return
+}
+
+// chart dimensions, in SVG user units
+const (
+	chartWidth  = 500.0
+	chartHeight = 220.0
+	chartBins   = 48
+)
+
+// Chart is an SVG chart of the bins, drawn as bars or as a line
+type Chart struct {
+	Bars   []Bar
+	Points string
+	Max    string
+	From   string
+	To     string
+}
+
+// Bar is a bar in a chart, or a point on the line
+type Bar struct {
+	X, Y, Width, Height float64
+	Title               string
+}
+
+// chart the bins, with value picking what to plot from each bin
+func chart(bins []Bin, value func(Bin) float64, format string) (c Chart) {
+	max := 0.0
+	for _, b := range bins {
+		if v := value(b); v > max {
+			max = v
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	width := chartWidth / float64(len(bins))
+	var points []string
+	for i, b := range bins {
+		v := value(b)
+		h := v / max * chartHeight
+		bar := Bar{
+			X:      float64(i) * width,
+			Y:      chartHeight - h,
+			Width:  width - 1,
+			Height: h,
+			Title:  b.Start.Format("Jan 2 15:04") + ": " + fmt.Sprintf(format, v),
+		}
+		c.Bars = append(c.Bars, bar)
+		points = append(points, fmt.Sprintf("%.1f,%.1f", bar.X+width/2, bar.Y))
+	}
+	c.Points = strings.Join(points, " ")
+	c.Max = fmt.Sprintf(format, max)
+	if len(bins) > 0 {
+		c.From = bins[0].Start.Format("Jan 2 15:04")
+		c.To = "now"
+	}
+	return
+}
+
+// Analytics is what the responder page shows about a route
+type Analytics struct {
+	Window   time.Duration
+	Visits   Chart
+	Latency  Chart
+	Statuses []StatusCount
+	Total    int
+}
+
+// the analytics for the routes of a responder over the window
+func routeAnalytics(routes []string) (a Analytics) {
+	bins, statuses := analytics.series(routes, chartBins, time.Now())
+	a.Window = analytics.window
+	a.Visits = chart(bins, func(b Bin) float64 { return float64(b.Count) }, "%.0f requests")
+	a.Latency = chart(bins, func(b Bin) float64 { return b.AvgMs }, "%.1f ms")
+	a.Statuses = statuses
+	for _, s := range statuses {
+		a.Total += s.Count
+	}
+	for i := range a.Statuses {
+		a.Statuses[i].Share = float64(a.Statuses[i].Count) / float64(a.Total) * 100
+	}
+	return
+}
+
+// the window for display eg 24h
+func (a Analytics) Period() string {
+	return strings.TrimSuffix(strings.TrimSuffix(a.Window.String(), "0s"), "0m")
+}
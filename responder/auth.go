@@ -32,6 +32,7 @@ func loggedIn(handler httprouter.Handle) httprouter.Handle {
 			return
 		}
 		p = append(p, httprouter.Param{Key: "userId", Value: strconv.Itoa(s.UserId)})
+		p = append(p, httprouter.Param{Key: "email", Value: s.Email})
 		handler(w, r, p)
 	}
 }
@@ -23,9 +23,10 @@ type Manifest struct {
 	Groups []struct {
 		Language   string `json:"language"`
 		Responders []struct {
-			ID    string `json:"id"`
-			Path  string `json:"path"`
-			Count int    `json:"-"`
+			ID     string   `json:"id"`
+			Path   string   `json:"path"`
+			Routes []string `json:"routes"`
+			Count  int      `json:"-"`
 		} `json:"responders"`
 	} `json:"routes"`
 }
@@ -131,6 +132,23 @@ func getManifest() (m Manifest, err error) {
 	return
 }
 
+// the routes handled by a responder, a responder built with a router lists
+// its routes in the manifest, otherwise its ID is the route
+func responderRoutes(id string) []string {
+	manifest, err := getManifest()
+	if err != nil {
+		danger("Cannot get manifest:", err)
+	}
+	for _, group := range manifest.Groups {
+		for _, r := range group.Responders {
+			if r.ID == id && len(r.Routes) > 0 {
+				return r.Routes
+			}
+		}
+	}
+	return []string{id}
+}
+
 func buildResponder(id, path, lang string) (err error) {
 	if lang == "go" {
 		err = build(path, id)
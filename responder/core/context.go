@@ -0,0 +1,42 @@
+package responder
+
+import (
+	"context"
+	"github.com/sausheong/legion/trace"
+	"time"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	traceParentKey
+	usernameKey
+	sessionKey
+)
+
+// the context for handling a request, with the deadline the acceptor gave
+// counted from when the request was received, so clock differences between
+// the acceptor and the responder don't matter
+func requestContext(req RequestInfo, span *trace.Span, received time.Time) (ctx context.Context, cancel context.CancelFunc) {
+	ctx = context.WithValue(context.Background(), requestIDKey, req.RequestID)
+	ctx = context.WithValue(ctx, traceParentKey, span.TraceParent())
+	if req.Timeout > 0 {
+		return context.WithDeadline(ctx, received.Add(time.Duration(req.Timeout)*time.Millisecond))
+	}
+	return context.WithCancel(ctx)
+}
+
+// RequestID gets the ID of the request being handled from the context
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// TraceParent gets the W3C traceparent of the request being handled from
+// the context, set it as the traceparent header on calls to other services
+// to continue the trace
+func TraceParent(ctx context.Context) string {
+	tp, _ := ctx.Value(traceParentKey).(string)
+	return tp
+}
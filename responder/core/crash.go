@@ -0,0 +1,108 @@
+package responder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// crash reports are published to this subject, where the control plane
+// collects them
+const crashesSubject = "_red.crashes"
+
+// CrashReport describes a panic in a responder while handling a request
+type CrashReport struct {
+	Route     string         `json:"route"`
+	Instance  string         `json:"instance"`
+	RequestID string         `json:"request_id"`
+	Panic     string         `json:"panic"`
+	Stack     string         `json:"stack"`
+	Time      time.Time      `json:"time"`
+	Request   RequestSummary `json:"request"`
+}
+
+// RequestSummary is the part of the request kept in a crash report, the
+// body and headers are left out as they may hold sensitive data
+type RequestSummary struct {
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	Query         string `json:"query"`
+	RemoteAddr    string `json:"remote_addr"`
+	ContentType   string `json:"content_type"`
+	ContentLength int64  `json:"content_length"`
+}
+
+// run f, recovering from a panic by logging the stack trace and reporting
+// the crash, returns true if f panicked
+func recovered(ctx context.Context, req RequestInfo, f func()) (crashed bool) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		crashed = true
+		stack := debug.Stack()
+		dangerContext(ctx, "Recovered from panic:", r, "\n"+string(stack))
+		metrics.fail()
+		reportCrash(req, r, stack)
+	}()
+	f()
+	return
+}
+
+// publish a crash report for the panic
+func reportCrash(req RequestInfo, r interface{}, stack []byte) {
+	if conn == nil {
+		return
+	}
+	contentType := ""
+	if v := req.Header["Content-Type"]; len(v) > 0 {
+		contentType = v[0]
+	}
+	report := CrashReport{
+		Route:     ROUTEID,
+		Instance:  instanceID(),
+		RequestID: req.RequestID,
+		Panic:     fmt.Sprint(r),
+		Stack:     string(stack),
+		Time:      time.Now(),
+		Request: RequestSummary{
+			Method:        req.Method,
+			Path:          req.URL.Path,
+			Query:         req.URL.RawQuery,
+			RemoteAddr:    req.RemoteAddr,
+			ContentType:   contentType,
+			ContentLength: req.ContentLength,
+		},
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		danger("Cannot marshal crash report", err)
+		return
+	}
+	err = conn.Publish(crashesSubject, data)
+	if err != nil {
+		danger("Cannot publish crash report", err)
+	}
+}
+
+// the response sent in place of the one the responder failed to give, as
+// problem details like the acceptor's own errors
+func crashResponse(req RequestInfo) (resp ResponseInfo) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type":       "about:blank",
+		"title":      "Internal Server Error",
+		"status":     500,
+		"detail":     "The responder failed to handle the request",
+		"instance":   req.URL.Path,
+		"route":      ROUTEID,
+		"request_id": req.RequestID,
+	})
+	resp.Status = "500"
+	resp.Header = map[string][]string{"Content-Type": {"application/problem+json"}}
+	resp.Body = string(body)
+	resp.Encoding = "text"
+	return
+}
@@ -0,0 +1,25 @@
+package responder
+
+import (
+	"encoding/json"
+)
+
+// Event is a Server-Sent Event, relayed by the acceptor to every client of
+// the SSE routes on a stream, the acceptor numbers events without an ID
+type Event struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Data  string `json:"data"`
+	Retry int    `json:"retry"`
+}
+
+// Publish sends an event to a stream, the stream of an SSE route is named
+// in the manifest, or is the route ID if not named
+func Publish(stream string, event Event) (err error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	err = conn.Publish("_red.sse."+stream, data)
+	return
+}
@@ -0,0 +1,246 @@
+package responder
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// the store is kept by the control plane, which answers requests on this
+// subject, so all instances of all responders share the same data
+const kvSubject = "_red.kv"
+
+// how long to wait for the store to reply
+var kvTimeout = 5 * time.Second
+
+// ErrConflict is returned by CompareAndSwap and Batch.Commit when a key
+// doesn't have the expected value, nothing is changed
+var ErrConflict = errors.New("store: value changed")
+
+type kvRequest struct {
+	Op     string      `json:"op"`
+	Bucket string      `json:"bucket"`
+	Key    string      `json:"key"`
+	Value  []byte      `json:"value,omitempty"`
+	TTL    int64       `json:"ttl,omitempty"`
+	Prefix string      `json:"prefix,omitempty"`
+	Cursor string      `json:"cursor,omitempty"`
+	Limit  int         `json:"limit,omitempty"`
+	Check  string      `json:"check,omitempty"`
+	Expect []byte      `json:"expect,omitempty"`
+	Delta  int64       `json:"delta,omitempty"`
+	Ops    []kvRequest `json:"ops,omitempty"`
+}
+
+type kvReply struct {
+	Value    []byte  `json:"value,omitempty"`
+	Found    bool    `json:"found"`
+	Entries  []Entry `json:"entries,omitempty"`
+	Next     string  `json:"next,omitempty"`
+	Number   int64   `json:"number,omitempty"`
+	Conflict bool    `json:"conflict,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Entry is a key and its value, returned by List
+type Entry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// send a request to the store and wait for the reply
+func kvCall(req kvRequest) (reply kvReply, err error) {
+	if conn == nil {
+		err = errors.New("not connected to the NATS server")
+		return
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	msg, err := conn.Request(kvSubject, data, kvTimeout)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(msg.Data, &reply)
+	if err == nil && reply.Error != "" {
+		err = errors.New(reply.Error)
+	} else if err == nil && reply.Conflict {
+		err = ErrConflict
+	}
+	return
+}
+
+// store a byte array with a bucket and a key
+func Store(bucket string, key string, value []byte) (err error) {
+	_, err = kvCall(kvRequest{Op: "store", Bucket: bucket, Key: key, Value: value})
+	return
+}
+
+// store a byte array that expires after the ttl, storing the key again
+// without a ttl keeps it for good
+func StoreTTL(bucket string, key string, value []byte, ttl time.Duration) (err error) {
+	_, err = kvCall(kvRequest{Op: "store", Bucket: bucket, Key: key, Value: value, TTL: ttl.Milliseconds()})
+	return
+}
+
+// get a byte array with a bucket and a key, the value is empty if the key
+// or the bucket doesn't exist
+func Get(bucket string, key string) (value string, err error) {
+	reply, err := kvCall(kvRequest{Op: "get", Bucket: bucket, Key: key})
+	value = string(reply.Value)
+	return
+}
+
+// get a byte array with a bucket and a key, and whether the key exists
+func Lookup(bucket string, key string) (value []byte, found bool, err error) {
+	reply, err := kvCall(kvRequest{Op: "get", Bucket: bucket, Key: key})
+	return reply.Value, reply.Found, err
+}
+
+func Delete(bucket string, key string) (err error) {
+	_, err = kvCall(kvRequest{Op: "delete", Bucket: bucket, Key: key})
+	return
+}
+
+// store a value as JSON
+func StoreJSON(bucket string, key string, v interface{}) (err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	return Store(bucket, key, data)
+}
+
+// get a value stored as JSON into v, found is false and v is left as it is
+// if the key doesn't exist
+func GetJSON(bucket string, key string, v interface{}) (found bool, err error) {
+	data, found, err := Lookup(bucket, key)
+	if err != nil || !found {
+		return
+	}
+	err = json.Unmarshal(data, v)
+	return
+}
+
+// the most keys List gets, use ListPage for more
+const maxListEntries = 10000
+
+// ErrTooManyKeys is returned by List, with the first keys, when there are
+// more keys than it gets
+var ErrTooManyKeys = errors.New("store: too many keys to list, use ListPage")
+
+// list the keys in a bucket starting with the prefix, in key order
+func List(bucket string, prefix string) (entries []Entry, err error) {
+	cursor := ""
+	for {
+		var page []Entry
+		page, cursor, err = ListPage(bucket, prefix, cursor, 0)
+		if err != nil {
+			return
+		}
+		entries = append(entries, page...)
+		if cursor == "" {
+			return
+		}
+		if len(entries) >= maxListEntries {
+			err = ErrTooManyKeys
+			return
+		}
+	}
+}
+
+// list a page of the keys in a bucket starting with the prefix, after the
+// cursor, which is empty for the first page, next is the cursor for the
+// following page and empty after the last page, the store picks the page
+// size if limit is 0, and ends a page early if it would be too large for
+// a NATS message
+//
+//	entries, next, err := responder.ListPage("carts", "alice/", "", 50)
+func ListPage(bucket string, prefix string, cursor string, limit int) (entries []Entry, next string, err error) {
+	reply, err := kvCall(kvRequest{Op: "list", Bucket: bucket, Prefix: prefix, Cursor: cursor, Limit: limit})
+	return reply.Entries, reply.Next, err
+}
+
+// replace the value of a key only if it still has the old value, a nil old
+// value means the key must not exist yet, returns ErrConflict if the value
+// has changed, the key keeps its expiry time
+func CompareAndSwap(bucket string, key string, old []byte, value []byte) (err error) {
+	_, err = kvCall(expect(kvRequest{Op: "cas", Bucket: bucket, Key: key, Value: value}, old))
+	return
+}
+
+// add delta to the number stored with the key, which starts at 0, and get
+// the new number, the key keeps its expiry time
+func Increment(bucket string, key string, delta int64) (n int64, err error) {
+	reply, err := kvCall(kvRequest{Op: "incr", Bucket: bucket, Key: key, Delta: delta})
+	return reply.Number, err
+}
+
+// Batch is a set of changes to the store made together, either all of them
+// are made or none are
+//
+//	b := responder.NewBatch()
+//	b.Expect("stock", "apples", []byte("3"))
+//	b.Store("stock", "apples", []byte("2"))
+//	b.Store("carts", "alice/apples", []byte("1"))
+//	err := b.Commit()
+type Batch struct {
+	ops []kvRequest
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// store a byte array as part of the batch
+func (b *Batch) Store(bucket string, key string, value []byte) *Batch {
+	b.ops = append(b.ops, kvRequest{Op: "store", Bucket: bucket, Key: key, Value: value})
+	return b
+}
+
+// store a byte array that expires after the ttl as part of the batch
+func (b *Batch) StoreTTL(bucket string, key string, value []byte, ttl time.Duration) *Batch {
+	b.ops = append(b.ops, kvRequest{Op: "store", Bucket: bucket, Key: key, Value: value, TTL: ttl.Milliseconds()})
+	return b
+}
+
+// delete a key as part of the batch
+func (b *Batch) Delete(bucket string, key string) *Batch {
+	b.ops = append(b.ops, kvRequest{Op: "delete", Bucket: bucket, Key: key})
+	return b
+}
+
+// add delta to a number as part of the batch
+func (b *Batch) Increment(bucket string, key string, delta int64) *Batch {
+	b.ops = append(b.ops, kvRequest{Op: "incr", Bucket: bucket, Key: key, Delta: delta})
+	return b
+}
+
+// make the batch fail with ErrConflict unless the key has the value when
+// the batch is committed, a nil value means the key must not exist
+func (b *Batch) Expect(bucket string, key string, value []byte) *Batch {
+	b.ops = append(b.ops, expect(kvRequest{Op: "check", Bucket: bucket, Key: key}, value))
+	return b
+}
+
+// add the condition that the key has the value, or doesn't exist if the
+// value is nil
+func expect(req kvRequest, value []byte) kvRequest {
+	if value == nil {
+		req.Check = "absent"
+	} else {
+		req.Check = "value"
+		req.Expect = value
+	}
+	return req
+}
+
+// make the changes in the batch, in the order they were added
+func (b *Batch) Commit() (err error) {
+	if len(b.ops) == 0 {
+		return
+	}
+	_, err = kvCall(kvRequest{Op: "batch", Ops: b.ops})
+	return
+}
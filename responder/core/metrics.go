@@ -0,0 +1,100 @@
+package responder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metrics are pushed to this subject, where the acceptor serves them for
+// Prometheus to scrape, labelled with the route and the instance
+const metricsSubject = "_red.metrics"
+
+// how often the metrics are pushed
+const metricsInterval = 5 * time.Second
+
+// latency histogram buckets in seconds, the same as the acceptor's
+var buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	Counts []uint64 `json:"counts"`
+	Sum    float64  `json:"sum"`
+	Count  uint64   `json:"count"`
+}
+
+// handlerMetrics are the metrics for this responder instance
+type handlerMetrics struct {
+	mutex    sync.Mutex
+	Route    string            `json:"route"`
+	Instance string            `json:"instance"`
+	Requests map[string]uint64 `json:"requests"`
+	Duration histogram         `json:"duration"`
+	InFlight int64             `json:"in_flight"`
+	Errors   uint64            `json:"errors"`
+}
+
+var metrics = &handlerMetrics{
+	Requests: make(map[string]uint64),
+	Duration: histogram{Counts: make([]uint64, len(buckets))},
+}
+
+// each instance is told apart by its host and process ID
+func instanceID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func (m *handlerMetrics) begin() {
+	m.mutex.Lock()
+	m.InFlight++
+	m.mutex.Unlock()
+}
+
+// record a handled request with the status the responder replied with
+func (m *handlerMetrics) done(status string, duration time.Duration) {
+	class := "unknown"
+	if code, err := strconv.Atoi(status); err == nil {
+		class = fmt.Sprintf("%dxx", code/100)
+	}
+	seconds := duration.Seconds()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.InFlight--
+	m.Requests[class]++
+	for i, le := range buckets {
+		if seconds <= le {
+			m.Duration.Counts[i]++
+		}
+	}
+	m.Duration.Sum += seconds
+	m.Duration.Count++
+}
+
+// record a request that could not be handled
+func (m *handlerMetrics) fail() {
+	m.mutex.Lock()
+	m.Errors++
+	m.mutex.Unlock()
+}
+
+// push the metrics to the acceptor periodically
+func pushMetrics() {
+	metrics.Route = ROUTEID
+	metrics.Instance = instanceID()
+	for range time.Tick(metricsInterval) {
+		metrics.mutex.Lock()
+		data, err := json.Marshal(metrics)
+		metrics.mutex.Unlock()
+		if err != nil {
+			danger("Cannot marshal metrics", err)
+			continue
+		}
+		err = conn.Publish(metricsSubject, data)
+		if err != nil {
+			warning("Cannot publish metrics", err)
+		}
+	}
+}
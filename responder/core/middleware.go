@@ -0,0 +1,267 @@
+package responder
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handler responds to a request
+type Handler func(context.Context, RequestInfo, *ResponseInfo)
+
+// Middleware wraps a handler to do something before or after it, or to
+// respond instead of it
+type Middleware func(next Handler) Handler
+
+// middleware used by all the handlers of the responder
+var middleware []Middleware
+
+// Use adds middleware around the responder's handlers, the first
+// middleware is the outermost, call it before Run, RunContext or Router.Run
+//
+//	responder.Use(responder.Logger(), responder.Recover())
+func Use(mw ...Middleware) {
+	middleware = append(middleware, mw...)
+}
+
+// wrap the handler in the middleware
+func chain(h Handler) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Recover replies with a 500 if the handler panics, so the middleware
+// around it sees the failed response, the panic is logged and reported
+// like a panic that reaches core.Run
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+			if recovered(ctx, req, func() { next(ctx, req, resp) }) {
+				*resp = crashResponse(req)
+			}
+		}
+	}
+}
+
+// Logger logs each request with the status and the time taken
+func Logger() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+			start := time.Now()
+			next(ctx, req, resp)
+			infoContext(ctx, req.Method, req.URL.Path, resp.Status, time.Since(start))
+		}
+	}
+}
+
+// BasicAuth requires HTTP basic authentication, checking the username and
+// password with the given function, and replies with a 401 if they are
+// missing or wrong
+func BasicAuth(realm string, check func(username, password string) bool) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+			username, password, ok := basicAuth(req.GetHeader("Authorization"))
+			if !ok || !check(username, password) {
+				resp.Status = "401"
+				resp.AddHeader("WWW-Authenticate", `Basic realm=`+strconv.Quote(realm))
+				resp.SetString("Unauthorized")
+				return
+			}
+			next(context.WithValue(ctx, usernameKey, username), req, resp)
+		}
+	}
+}
+
+// parse the credentials from a basic Authorization header
+func basicAuth(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return
+	}
+	username, password, ok = strings.Cut(string(decoded), ":")
+	return
+}
+
+// Credentials checks a username and password against a fixed pair, in
+// constant time, for use with BasicAuth
+func Credentials(username, password string) func(string, string) bool {
+	return func(u, p string) bool {
+		userOk := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		return userOk && passOk
+	}
+}
+
+// Username gets the user authenticated by BasicAuth from the context
+func Username(ctx context.Context) string {
+	username, _ := ctx.Value(usernameKey).(string)
+	return username
+}
+
+// CORSOptions are the cross-origin requests allowed by CORS
+// an origin of * allows every origin
+type CORSOptions struct {
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Credentials bool
+	MaxAge      time.Duration
+}
+
+// CORS sets the CORS headers for requests from allowed origins and answers
+// preflight requests, the acceptor only passes preflight requests on if
+// the manifest has an OPTIONS route for the path
+func CORS(options CORSOptions) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+			origin := req.GetHeader("Origin")
+			if origin == "" || !allowedOrigin(options.Origins, origin) {
+				next(ctx, req, resp)
+				return
+			}
+			if len(options.Origins) == 1 && options.Origins[0] == "*" && !options.Credentials {
+				resp.AddHeader("Access-Control-Allow-Origin", "*")
+			} else {
+				resp.AddHeader("Access-Control-Allow-Origin", origin)
+				resp.AddHeader("Vary", "Origin")
+			}
+			if options.Credentials {
+				resp.AddHeader("Access-Control-Allow-Credentials", "true")
+			}
+			if req.Method == "OPTIONS" && req.GetHeader("Access-Control-Request-Method") != "" {
+				if len(options.Methods) > 0 {
+					resp.AddHeader("Access-Control-Allow-Methods", strings.Join(options.Methods, ", "))
+				}
+				if len(options.Headers) > 0 {
+					resp.AddHeader("Access-Control-Allow-Headers", strings.Join(options.Headers, ", "))
+				}
+				if options.MaxAge > 0 {
+					resp.AddHeader("Access-Control-Max-Age", strconv.Itoa(int(options.MaxAge.Seconds())))
+				}
+				resp.Status = "204"
+				return
+			}
+			next(ctx, req, resp)
+		}
+	}
+}
+
+func allowedOrigin(origins []string, origin string) bool {
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Session is the data kept for a client between requests, in the
+// responder's store, identified by a cookie
+type Session struct {
+	ID      string
+	Values  map[string]string
+	changed bool
+}
+
+// Get a value from the session
+func (s *Session) Get(key string) string {
+	return s.Values[key]
+}
+
+// Set a value in the session, the session is saved after the handler runs
+func (s *Session) Set(key, value string) {
+	s.Values[key] = value
+	s.changed = true
+}
+
+// Delete a value from the session
+func (s *Session) Delete(key string) {
+	delete(s.Values, key)
+	s.changed = true
+}
+
+// the store bucket sessions are kept in
+const sessionBucket = "sessions"
+
+// the cookie sessions are named by and how long they last if
+// SessionOptions doesn't say
+const (
+	defaultSessionCookie = "session"
+	defaultSessionMaxAge = 24 * time.Hour
+)
+
+// the store functions sessions use, replaced in tests
+var (
+	lookupSession = Lookup
+	storeSession  = StoreTTL
+)
+
+// SessionOptions are the cookie and lifetime of the sessions kept by
+// Sessions, a session expires MaxAge after it was last changed, the cookie
+// is "session" and sessions last a day unless they are set
+type SessionOptions struct {
+	Cookie string
+	MaxAge time.Duration
+	Secure bool
+}
+
+// Sessions loads the session named by the cookie before the handler runs,
+// and saves it afterwards if the handler changed it, setting the cookie
+// again so it expires with the session
+//
+//	responder.Use(responder.Sessions(responder.SessionOptions{Cookie: "sid", Secure: true}))
+func Sessions(options SessionOptions) Middleware {
+	if options.Cookie == "" {
+		options.Cookie = defaultSessionCookie
+	}
+	if options.MaxAge <= 0 {
+		options.MaxAge = defaultSessionMaxAge
+	}
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+			session := &Session{ID: req.GetCookie(options.Cookie), Values: make(map[string]string)}
+			found := false
+			if session.ID != "" {
+				data, ok, err := lookupSession(sessionBucket, session.ID)
+				found = err == nil && ok && json.Unmarshal(data, &session.Values) == nil
+			}
+			if !found {
+				session.ID = CreateUUID()
+			}
+			next(context.WithValue(ctx, sessionKey, session), req, resp)
+			if !session.changed {
+				return
+			}
+			data, err := json.Marshal(session.Values)
+			if err == nil {
+				err = storeSession(sessionBucket, session.ID, data, options.MaxAge)
+			}
+			if err != nil {
+				dangerContext(ctx, "Cannot save session", session.ID, err)
+				return
+			}
+			cookie := options.Cookie + "=" + session.ID + "; Path=/; Max-Age=" + strconv.Itoa(int(options.MaxAge.Seconds())) + "; HttpOnly; SameSite=Lax"
+			if options.Secure {
+				cookie += "; Secure"
+			}
+			resp.AddHeader("Set-Cookie", cookie)
+		}
+	}
+}
+
+// GetSession gets the session loaded by Sessions from the context, nil if
+// the Sessions middleware isn't used
+func GetSession(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey).(*Session)
+	return session
+}
@@ -0,0 +1,156 @@
+package responder
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger = log.New(io.Discard, "", 0)
+}
+
+func testRequest(header map[string][]string) (RequestInfo, *ResponseInfo) {
+	req := RequestInfo{Method: "GET", Header: header}
+	resp := &ResponseInfo{Status: "200", Header: make(map[string][]string)}
+	return req, resp
+}
+
+func TestChainOrder(t *testing.T) {
+	defer func() { middleware = nil }()
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+				order = append(order, name)
+				next(ctx, req, resp)
+			}
+		}
+	}
+	Use(mark("outer"), mark("inner"))
+	h := chain(func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+		order = append(order, "handler")
+	})
+	req, resp := testRequest(nil)
+	h(context.Background(), req, resp)
+	if len(order) != 3 || order[0] != "outer" || order[1] != "inner" || order[2] != "handler" {
+		t.Error("wrong order:", order)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	called := false
+	h := BasicAuth("red", Credentials("alice", "secret"))(func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+		called = Username(ctx) == "alice"
+	})
+	req, resp := testRequest(map[string][]string{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong"))}})
+	h(context.Background(), req, resp)
+	if called || resp.Status != "401" || resp.Header["WWW-Authenticate"][0] != `Basic realm="red"` {
+		t.Error("wrong credentials accepted:", resp.Status, resp.Header)
+	}
+	req, resp = testRequest(map[string][]string{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))}})
+	h(context.Background(), req, resp)
+	if !called || resp.Status != "200" {
+		t.Error("right credentials rejected:", resp.Status)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	called := false
+	h := CORS(CORSOptions{Origins: []string{"https://example.com"}, Methods: []string{"GET", "POST"}})(func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+		called = true
+	})
+	req, resp := testRequest(map[string][]string{"Origin": {"https://example.com"}, "Access-Control-Request-Method": {"POST"}})
+	req.Method = "OPTIONS"
+	h(context.Background(), req, resp)
+	if called || resp.Status != "204" || resp.Header["Access-Control-Allow-Methods"][0] != "GET, POST" {
+		t.Error("wrong preflight response:", resp.Status, resp.Header)
+	}
+	req, resp = testRequest(map[string][]string{"Origin": {"https://evil.example"}})
+	h(context.Background(), req, resp)
+	if !called || resp.Header["Access-Control-Allow-Origin"] != nil {
+		t.Error("disallowed origin got CORS headers:", resp.Header)
+	}
+}
+
+func TestRecoverResponse(t *testing.T) {
+	defer func() { middleware = nil }()
+	status := ""
+	outer := func(next Handler) Handler {
+		return func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+			next(ctx, req, resp)
+			status = resp.Status
+		}
+	}
+	Use(outer, Recover())
+	h := chain(func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+		panic("out of apples")
+	})
+	req, resp := testRequest(nil)
+	h(context.Background(), req, resp)
+	if status != "500" || resp.Header["Content-Type"][0] != "application/problem+json" {
+		t.Error("outer middleware didn't see the 500:", status, resp.Header)
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	saved := make(map[string][]byte)
+	var ttl time.Duration
+	lookupSession = func(bucket, key string) ([]byte, bool, error) {
+		value, found := saved[key]
+		return value, found, nil
+	}
+	storeSession = func(bucket, key string, value []byte, maxAge time.Duration) error {
+		saved[key], ttl = value, maxAge
+		return nil
+	}
+	defer func() { lookupSession, storeSession = Lookup, StoreTTL }()
+
+	h := Sessions(SessionOptions{Cookie: "sid", MaxAge: time.Hour, Secure: true})(func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+		session := GetSession(ctx)
+		if req.URL.Path == "/add" {
+			session.Set("cart", session.Get("cart")+"apple;")
+		}
+		resp.SetString(session.Get("cart"))
+	})
+	req, resp := testRequest(nil)
+	req.URL.Path = "/add"
+	h(context.Background(), req, resp)
+	cookie := resp.Header["Set-Cookie"]
+	if len(cookie) != 1 || !strings.Contains(cookie[0], "Max-Age=3600") || !strings.HasSuffix(cookie[0], "; Secure") || ttl != time.Hour {
+		t.Fatal("wrong session cookie:", cookie, ttl)
+	}
+	id := strings.TrimPrefix(strings.Split(cookie[0], ";")[0], "sid=")
+
+	req, resp = testRequest(map[string][]string{"Cookie": {"sid=" + id}})
+	h(context.Background(), req, resp)
+	if resp.Body != "apple;" || resp.Header["Set-Cookie"] != nil {
+		t.Error("session not loaded:", resp.Body, resp.Header)
+	}
+}
+
+func TestSessionDefaults(t *testing.T) {
+	var ttl time.Duration
+	lookupSession = func(bucket, key string) ([]byte, bool, error) {
+		return nil, false, nil
+	}
+	storeSession = func(bucket, key string, value []byte, maxAge time.Duration) error {
+		ttl = maxAge
+		return nil
+	}
+	defer func() { lookupSession, storeSession = Lookup, StoreTTL }()
+
+	h := Sessions(SessionOptions{})(func(ctx context.Context, req RequestInfo, resp *ResponseInfo) {
+		GetSession(ctx).Set("seen", "yes")
+	})
+	req, resp := testRequest(nil)
+	h(context.Background(), req, resp)
+	cookie := resp.Header["Set-Cookie"]
+	if len(cookie) != 1 || !strings.HasPrefix(cookie[0], "session=") || strings.HasPrefix(cookie[0], "session=;") || ttl != 24*time.Hour {
+		t.Error("wrong default session cookie:", cookie, ttl)
+	}
+}
@@ -1,17 +1,22 @@
 package responder
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/nats-io/go-nats"
+	"github.com/nats-io/nats.go"
+	"github.com/sausheong/legion/trace"
 	"log"
 	"os"
-	"runtime"
+	"time"
 )
 
 var ROUTEID string
 var QUEUE string
 
+// the connection to the NATS server, shared by everything in the responder
+var conn *nats.Conn
+
 func init() {
 	ROUTEID = os.Getenv("ID")
 	QUEUE = os.Getenv("QUEUE")
@@ -19,27 +24,48 @@ func init() {
 
 // Run subscribe to a subject with a given callback function
 func Run(respond func(RequestInfo, *ResponseInfo)) {
-	// setup log file
-	file, err := os.OpenFile("responder.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalln("Failed to open log file", err)
-	}
-	logger = log.New(file, "INFO ", log.Ldate|log.Ltime|log.Lshortfile)
+	RunContext(func(_ context.Context, req RequestInfo, resp *ResponseInfo) {
+		respond(req, resp)
+	})
+}
 
-	// connect to localhost NATS server
-	conn, err := nats.Connect(QUEUE)
-	if err != nil {
-		danger("Cannot connect to NATS server", err)
-	}
+// RunContext is like Run, but the callback function also gets a context
+// that is done when the acceptor stops waiting for the reply, and carries
+// the request ID and the trace context for calls to other services
+func RunContext(respond func(context.Context, RequestInfo, *ResponseInfo)) {
+	setup()
+	serve(map[string]nats.MsgHandler{ROUTEID: handler(respond)})
+}
 
-	// create callback function for subscription
-	action := func(msg *nats.Msg) {
+// create callback function for subscription, with the middleware around
+// the respond function, each subscription handles its messages in its own
+// goroutine so the routes of a responder are handled at the same time,
+// anything a request needs is kept in its context
+func handler(respond Handler) nats.MsgHandler {
+	respond = chain(respond)
+	return func(msg *nats.Msg) {
+		received := time.Now()
 		var req_info RequestInfo
 		// unmarshal JSON from message data
-		err = json.Unmarshal(msg.Data, &req_info)
+		err := json.Unmarshal(msg.Data, &req_info)
 		if err != nil {
 			danger("Cannot unmarshal message to JSON", err)
+			metrics.fail()
+		}
+
+		// handling the request is traced as a child of the acceptor's span
+		handle := trace.StartSpan("responder handle", trace.Server, req_info.TraceParent)
+		handle.Start = received
+		handle.Set("red.request_id", req_info.RequestID)
+		handle.Set("red.route", msg.Subject)
+		defer handle.End()
+		unmarshal := handle.Child("unmarshal", trace.Internal)
+		unmarshal.Start = received
+		if err != nil {
+			unmarshal.Fail(err.Error())
 		}
+		unmarshal.End()
+
 		// call act function to respond to the request
 		resp_info := ResponseInfo{}
 
@@ -49,21 +75,79 @@ func Run(respond func(RequestInfo, *ResponseInfo)) {
 		// initialize to an empty header
 		resp_info.Header = make(map[string][]string)
 		// call the respond function passed in from the responder
-		respond(req_info, &resp_info)
+		respondSpan := handle.Child("respond", trace.Internal)
+		ctx, cancel := requestContext(req_info, respondSpan, received)
+		metrics.begin()
+		// a panic in the responder fails the request, not the responder
+		if recovered(ctx, req_info, func() { respond(ctx, req_info, &resp_info) }) {
+			resp_info = crashResponse(req_info)
+			respondSpan.Fail("responder panicked")
+		}
+		metrics.done(resp_info.Status, time.Since(received))
+		respondSpan.Set("http.status_code", resp_info.Status)
+		respondSpan.End()
 		//
 
+		reply := handle.Child("reply", trace.Internal)
+		defer reply.End()
+
 		// marshal response to JSON
 		resp_json, err := json.Marshal(resp_info)
 		if err != nil {
 			fmt.Println("Cannot marshal response to JSON", err)
-			danger("Cannot marshal response to JSON", err)
+			dangerContext(ctx, "Cannot marshal response to JSON", err)
+			reply.Fail(err.Error())
+			metrics.fail()
 		}
 		// reply through NATS server
-		conn.Publish(msg.Reply, []byte(resp_json))
+		if resp_info.stream == nil {
+			conn.Publish(msg.Reply, []byte(resp_json))
+			cancel()
+			return
+		}
+		// streamed replies and the chunks that follow them are sent after the
+		// callback returns so a slow client doesn't hold up the next message
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			defer cancel()
+			sendStream(ctx, conn, msg.Reply, resp_json, resp_info.stream, req_info)
+		}()
+	}
+}
+
+// set up the log file and connect to the NATS server
+func setup() {
+	// setup log file
+	file, err := os.OpenFile("responder.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatalln("Failed to open log file", err)
+	}
+	logger = log.New(file, "INFO ", log.Ldate|log.Ltime|log.Lshortfile)
+
+	// connect to localhost NATS server
+	conn, err = nats.Connect(QUEUE)
+	if err != nil {
+		danger("Cannot connect to NATS server", err)
 	}
+	go exportSpans()
+	go pushMetrics()
+}
+
+// subscribe to the routes with their callbacks and handle messages until
+// the responder is told to shut down
+func serve(actions map[string]nats.MsgHandler) {
 	// subscribe using queue with queue name same as route ID
 	// route ID is the subject as well as the queue name
-	conn.QueueSubscribe(ROUTEID, ROUTEID, action)
+	var subs []*nats.Subscription
+	for routeId, action := range actions {
+		sub, err := conn.QueueSubscribe(routeId, routeId, action)
+		if err != nil {
+			danger("Cannot subscribe to NATS server", routeId, err)
+			log.Fatalln("Cannot subscribe to NATS server", routeId, err)
+		}
+		subs = append(subs, sub)
+	}
 	conn.Flush()
 
 	if err := conn.LastError(); err != nil {
@@ -75,6 +159,23 @@ func Run(respond func(RequestInfo, *ResponseInfo)) {
 	fmt.Printf("%s responder ready\n", ROUTEID)
 	info(fmt.Sprintf("%s responder ready", ROUTEID))
 
-	runtime.Goexit()
-	conn.Close()
+	waitForShutdown(subs)
+}
+
+// send the responder's spans to the control plane every second
+func exportSpans() {
+	resource := []trace.Attribute{
+		trace.NewAttribute("service.name", "responder"),
+		trace.NewAttribute("red.route", ROUTEID),
+	}
+	trace.Setup(resource, map[string]string{"name": "red"}, func(data []byte) {
+		if conn == nil {
+			return
+		}
+		err := conn.Publish(trace.Subject, data)
+		if err != nil {
+			warning("Cannot publish spans", err)
+		}
+	})
+	trace.Export()
 }
@@ -0,0 +1,92 @@
+package responder
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"sort"
+	"strings"
+)
+
+// Router lets a single responder handle many routes, each route is
+// subscribed to as its own queue group so instances of the responder share
+// the requests for every route
+// the routes must match the routes the manifest lists for the responder
+// requests to different routes are handled at the same time, so handlers
+// that share data must guard it
+//
+//	r := responder.NewRouter()
+//	r.GET("/_/users/:id", getUser)
+//	r.POST("/_/users", createUser)
+//	r.Run()
+type Router struct {
+	handlers map[string]Handler
+}
+
+// NewRouter creates a router with no routes
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[string]Handler),
+	}
+}
+
+// HandleContext registers the callback function for the method and path,
+// the route ID is the method and path eg GET/_/users/:id
+func (r *Router) HandleContext(method, path string, respond func(context.Context, RequestInfo, *ResponseInfo)) {
+	routeId := strings.ToUpper(method) + path
+	if _, exists := r.handlers[routeId]; exists {
+		panic("route registered twice: " + routeId)
+	}
+	r.handlers[routeId] = respond
+}
+
+// Handle registers the callback function for the method and path
+func (r *Router) Handle(method, path string, respond func(RequestInfo, *ResponseInfo)) {
+	r.HandleContext(method, path, func(_ context.Context, req RequestInfo, resp *ResponseInfo) {
+		respond(req, resp)
+	})
+}
+
+// GET registers the callback function for GET requests to the path
+func (r *Router) GET(path string, respond func(RequestInfo, *ResponseInfo)) {
+	r.Handle("GET", path, respond)
+}
+
+// POST registers the callback function for POST requests to the path
+func (r *Router) POST(path string, respond func(RequestInfo, *ResponseInfo)) {
+	r.Handle("POST", path, respond)
+}
+
+// PUT registers the callback function for PUT requests to the path
+func (r *Router) PUT(path string, respond func(RequestInfo, *ResponseInfo)) {
+	r.Handle("PUT", path, respond)
+}
+
+// PATCH registers the callback function for PATCH requests to the path
+func (r *Router) PATCH(path string, respond func(RequestInfo, *ResponseInfo)) {
+	r.Handle("PATCH", path, respond)
+}
+
+// DELETE registers the callback function for DELETE requests to the path
+func (r *Router) DELETE(path string, respond func(RequestInfo, *ResponseInfo)) {
+	r.Handle("DELETE", path, respond)
+}
+
+// Routes lists the IDs of the routes registered with the router
+func (r *Router) Routes() (routeIds []string) {
+	for routeId := range r.handlers {
+		routeIds = append(routeIds, routeId)
+	}
+	sort.Strings(routeIds)
+	return
+}
+
+// Run subscribes to all the routes registered with the router
+func (r *Router) Run() {
+	setup()
+	actions := make(map[string]nats.MsgHandler)
+	for routeId, respond := range r.handlers {
+		actions[routeId] = handler(respond)
+		info("Handling route", routeId)
+	}
+	serve(actions)
+}
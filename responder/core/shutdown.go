@@ -0,0 +1,77 @@
+package responder
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/sausheong/legion/trace"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// how long to wait for the requests already delivered to be handled when
+// shutting down, unless SHUTDOWN_TIMEOUT sets another duration
+// the control plane sets SHUTDOWN_TIMEOUT for the responders it runs, to
+// end before it kills them
+const defaultShutdownTimeout = 10 * time.Second
+
+func shutdownTimeout() time.Duration {
+	if t := os.Getenv("SHUTDOWN_TIMEOUT"); t != "" {
+		timeout, err := time.ParseDuration(t)
+		if err == nil && timeout > 0 {
+			return timeout
+		}
+		warning("Ignoring invalid shutdown timeout", t)
+	}
+	return defaultShutdownTimeout
+}
+
+// wait for SIGTERM or SIGINT, then leave the queue group so no more
+// requests come in, finish the requests already delivered, flush the
+// replies and exit
+func waitForShutdown(subs []*nats.Subscription) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+
+	timeout := shutdownTimeout()
+	deadline := time.Now().Add(timeout)
+	info("Received", sig, "- shutting down, waiting up to", timeout, "for requests to finish")
+	for _, sub := range subs {
+		err := sub.Drain()
+		if err != nil {
+			warning("Cannot drain subscription", sub.Subject, err)
+		}
+	}
+	// the subscriptions are closed once their pending messages are handled
+	pending := func() bool {
+		for _, sub := range subs {
+			if sub.IsValid() {
+				return true
+			}
+		}
+		return false
+	}
+	for pending() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	// streamed bodies are still being sent after their messages are handled
+	if pending() || !waitForStreams(deadline) {
+		warning("Shutdown deadline passed with requests still pending")
+	} else {
+		info("All requests finished")
+	}
+
+	trace.Flush()
+	wait := time.Until(deadline)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	err := conn.FlushTimeout(wait)
+	if err != nil {
+		warning("Cannot flush replies", err)
+	}
+	conn.Close()
+	info(ROUTEID, "responder stopped")
+	os.Exit(0)
+}
@@ -0,0 +1,93 @@
+package responder
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+)
+
+// types of WebSocket events
+const (
+	SocketConnect = "connect"
+	SocketMessage = "message"
+	SocketClose   = "close"
+)
+
+// SocketEvent is a connect, message or close event on a WebSocket
+// connection, the request is only sent with the connect event
+type SocketEvent struct {
+	Type     string       `json:"type"`
+	ConnID   string       `json:"conn_id"`
+	Route    string       `json:"route"`
+	Data     string       `json:"data,omitempty"`
+	Encoding string       `json:"encoding,omitempty"`
+	Request  *RequestInfo `json:"request,omitempty"`
+}
+
+// a frame pushed to a WebSocket connection through the acceptor
+type socketFrame struct {
+	Data     string `json:"data"`
+	Encoding string `json:"encoding"`
+	Close    bool   `json:"close"`
+}
+
+// RunSocket subscribes to the events of a WebSocket route declared in the
+// manifest, calling onMessage for each event
+func RunSocket(onMessage func(SocketEvent)) {
+	setup()
+	action := func(msg *nats.Msg) {
+		var event SocketEvent
+		err := json.Unmarshal(msg.Data, &event)
+		if err != nil {
+			danger("Cannot unmarshal socket event", err)
+			return
+		}
+		req := RequestInfo{}
+		ctx := context.Background()
+		if event.Request != nil {
+			req = *event.Request
+			ctx = context.WithValue(ctx, requestIDKey, req.RequestID)
+		}
+		recovered(ctx, req, func() { onMessage(event) })
+	}
+	serve(map[string]nats.MsgHandler{ROUTEID: action})
+}
+
+// check if the message was sent as binary
+func (event *SocketEvent) IsBinary() bool {
+	return event.Encoding == "base64"
+}
+
+// get the message data, decoding it if it was sent as binary
+func (event *SocketEvent) Bytes() (data []byte, err error) {
+	if event.IsBinary() {
+		return base64.StdEncoding.DecodeString(event.Data)
+	}
+	data = []byte(event.Data)
+	return
+}
+
+// Send pushes a text message to a WebSocket connection
+func Send(connId string, text string) error {
+	return sendFrame(connId, socketFrame{Data: text, Encoding: "text"})
+}
+
+// SendBytes pushes a binary message to a WebSocket connection
+func SendBytes(connId string, data []byte) error {
+	return sendFrame(connId, socketFrame{Data: base64.StdEncoding.EncodeToString(data), Encoding: "base64"})
+}
+
+// CloseSocket closes a WebSocket connection
+func CloseSocket(connId string) error {
+	return sendFrame(connId, socketFrame{Close: true})
+}
+
+func sendFrame(connId string, frame socketFrame) (err error) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return
+	}
+	err = conn.Publish("_red.ws."+connId, data)
+	return
+}
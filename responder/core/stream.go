@@ -0,0 +1,114 @@
+package responder
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"io"
+	"sync"
+	"time"
+)
+
+// the largest piece of the body sent in a single chunk
+const chunkSize = 32 << 10
+
+// how long to wait for the acceptor to take each chunk
+var streamTimeout = 30 * time.Second
+
+// the streams being sent, which shutting down waits for
+var streams sync.WaitGroup
+
+// ErrStreamCancelled is returned by the stream writer when the acceptor
+// stops taking chunks, usually because the client went away
+var ErrStreamCancelled = errors.New("stream cancelled by the acceptor")
+
+// Stream sends the body in chunks as the given function writes them, for
+// large or slowly generated responses, instead of all in one reply
+// the function should stop writing once a write returns an error
+func (resp *ResponseInfo) Stream(write func(w io.Writer)) {
+	resp.Streamed = true
+	resp.stream = write
+}
+
+// sends each write to the acceptor as chunks, waiting for the acceptor to
+// acknowledge each chunk before sending the next
+type streamWriter struct {
+	conn    *nats.Conn
+	subject string
+	err     error
+}
+
+func (w *streamWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size := len(p)
+		if size > chunkSize {
+			size = chunkSize
+		}
+		err = w.send(chunk{Data: base64.StdEncoding.EncodeToString(p[:size])})
+		if err != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+	}
+	return
+}
+
+// send a chunk and wait for the acknowledgement
+func (w *streamWriter) send(c chunk) error {
+	if w.err != nil {
+		return w.err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	ack, err := w.conn.Request(w.subject, data, streamTimeout)
+	if err != nil {
+		w.err = err
+	} else if string(ack.Data) != "ok" {
+		w.err = ErrStreamCancelled
+	}
+	return w.err
+}
+
+// send the reply, wait for the acceptor to answer with the subject to send
+// the chunks to, then run the stream function and send the end of stream
+// marker, with an error if the stream function panicked, this runs in its
+// own goroutine after the message callback returns
+func sendStream(ctx context.Context, conn *nats.Conn, reply string, response []byte, write func(io.Writer), req RequestInfo) {
+	ready, err := conn.Request(reply, response, streamTimeout)
+	if err != nil {
+		warningContext(ctx, "Acceptor did not take the stream", err)
+		return
+	}
+	subject := string(ready.Data)
+	w := &streamWriter{conn: conn, subject: subject}
+	end := chunk{End: true}
+	if recovered(ctx, req, func() { write(w) }) {
+		end.Error = "responder panicked while streaming"
+	}
+	err = w.send(end)
+	if err != nil {
+		warningContext(ctx, "Stream to", subject, "ended early", err)
+	}
+}
+
+// wait for the streams being sent to finish, returns false if the deadline
+// passes first
+func waitForStreams(deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		streams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
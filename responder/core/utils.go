@@ -1,32 +1,68 @@
 package responder
 
 // Request and response info structs, utility functions and methods
-// Uses boltdb for
 
 import (
+	"context"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"github.com/boltdb/bolt"
+	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // for logging
 var logger *log.Logger
 
-func info(args ...interface{}) {
-	logger.SetPrefix("INFO [" + ROUTEID + "] - ")
+// many requests are handled at once, the prefix and the line are written
+// together
+var logging sync.Mutex
+
+// write a log line, prefixed with the route ID and the request ID if the
+// line is about a request
+func logLine(level string, requestID string, args ...interface{}) {
+	prefix := level + " [" + ROUTEID + "]"
+	if requestID != "" {
+		prefix += " [" + requestID + "]"
+	}
+	logging.Lock()
+	defer logging.Unlock()
+	logger.SetPrefix(prefix + " - ")
 	logger.Println(args...)
 }
 
+func info(args ...interface{}) {
+	logLine("INFO", "", args...)
+}
+
 func danger(args ...interface{}) {
-	logger.SetPrefix("ERROR [" + ROUTEID + "] - ")
-	logger.Println(args...)
+	logLine("ERROR", "", args...)
 }
 
 func warning(args ...interface{}) {
-	logger.SetPrefix("WARNING [" + ROUTEID + "] - ")
-	logger.Println(args...)
+	logLine("WARNING", "", args...)
+}
+
+// log lines about the request in the context, with its request ID
+
+func infoContext(ctx context.Context, args ...interface{}) {
+	logLine("INFO", RequestID(ctx), args...)
+}
+
+func dangerContext(ctx context.Context, args ...interface{}) {
+	logLine("ERROR", RequestID(ctx), args...)
+}
+
+func warningContext(ctx context.Context, args ...interface{}) {
+	logLine("WARNING", RequestID(ctx), args...)
 }
 
 type RequestInfo struct {
@@ -34,20 +70,30 @@ type RequestInfo struct {
 	URL              URLInfo                `json:"URL"`
 	Proto            string                 `json:"Proto"`
 	Header           map[string][]string    `json:"Header"`
-	Body             interface{}            `json:"Body"`
+	Body             string                 `json:"Body"`
+	BodyEncoding     string                 `json:"BodyEncoding"`
 	ContentLength    int64                  `json:"ContentLength"`
 	TransferEncoding []string               `json:"TransferEncoding"`
 	Host             string                 `json:"Host"`
 	Params           map[string][]string    `json:"Params"`
+	PathParams       map[string]string      `json:"PathParams"`
 	Multipart        map[string][]Multipart `json:"Multipart"`
 	RemoteAddr       string                 `json:"RemoteAddr"`
 	RequestURI       string                 `json:"RequestURI"`
+	RequestID        string                 `json:"RequestID"`
+	TraceParent      string                 `json:"TraceParent"`
+	// how long the acceptor waits for the reply, in milliseconds
+	Timeout int64 `json:"Timeout"`
 }
 
+// an uploaded file, spooled by the acceptor to the upload directory
+// the acceptor removes the file once the response is sent, use SaveTo to
+// keep it
 type Multipart struct {
 	Filename    string `json:"Filename"`
 	ContentType string `json:"ContentType"`
-	Content     string `json:"Content"`
+	Size        int64  `json:"Size"`
+	Path        string `json:"Path"`
 }
 
 type URLInfo struct {
@@ -60,9 +106,19 @@ type URLInfo struct {
 }
 
 type ResponseInfo struct {
-	Status string              `json:"status"`
-	Header map[string][]string `json:"header"`
-	Body   string              `json:"body"`
+	Status   string              `json:"status"`
+	Header   map[string][]string `json:"header"`
+	Body     string              `json:"body"`
+	Encoding string              `json:"encoding"`
+	Streamed bool                `json:"stream"`
+	stream   func(io.Writer)
+}
+
+// a piece of a streamed response body
+type chunk struct {
+	Data  string `json:"data"`
+	End   bool   `json:"end"`
+	Error string `json:"error,omitempty"`
 }
 
 // methods on RequestInfo
@@ -97,6 +153,65 @@ func (req *RequestInfo) GetParam(key string) (value string) {
 	return
 }
 
+// get a parameter captured from the route pattern eg id in /_/users/:id
+func (req *RequestInfo) GetPathParam(key string) (value string) {
+	return req.PathParams[key]
+}
+
+// get the raw request body, decoding it if the acceptor had to encode it
+func (req *RequestInfo) BodyBytes() (body []byte, err error) {
+	if req.BodyEncoding == "base64" {
+		return base64.StdEncoding.DecodeString(req.Body)
+	}
+	body = []byte(req.Body)
+	return
+}
+
+// unmarshal a JSON request body into v
+func (req *RequestInfo) BindJSON(v interface{}) (err error) {
+	body, err := req.BodyBytes()
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, v)
+	return
+}
+
+// get a file uploaded with the request
+func (req *RequestInfo) GetFile(key string) (file *Multipart) {
+	if len(req.Multipart[key]) > 0 {
+		file = &req.Multipart[key][0]
+	}
+	return
+}
+
+// methods on Multipart
+
+// open the uploaded file for reading
+func (m *Multipart) Open() (io.ReadCloser, error) {
+	return os.Open(m.Path)
+}
+
+// copy the uploaded file to the given path
+func (m *Multipart) SaveTo(path string) (err error) {
+	in, err := m.Open()
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := out.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	_, err = io.Copy(out, in)
+	return
+}
+
 // methods on ResponseInfo
 
 func (resp *ResponseInfo) AddHeader(key string, value string) {
@@ -123,60 +238,33 @@ func (resp *ResponseInfo) SetJSON() {
 	resp.AddHeader("Content-Type", "application/json; charset=utf-8")
 }
 
-// embedded db methods
-// store a byte array with a bucket and a key
-func Store(bucket string, key string, value []byte) (err error) {
-	db, err := bolt.Open("red.db", 0600, nil)
-	defer db.Close()
-	if err != nil {
-		return
-	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(bucket))
-		if err != nil {
-			return err
-		}
-		err = bucket.Put([]byte(key), value)
-		if err != nil {
-			return err
-		}
-		return err
-	})
-	return
+// set the body to a string, sent to the client as it is
+func (resp *ResponseInfo) SetString(body string) {
+	resp.Body = body
+	resp.Encoding = "text"
 }
 
-// get a byte array with a bucket and a key
-func Get(bucket string, key string) (value string, err error) {
-	db, err := bolt.Open("red.db", 0600, nil)
-	defer db.Close()
-	if err != nil {
-		return
-	}
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		if b == nil {
-			return fmt.Errorf("Bucket %q not found!", bucket)
-		}
-		value = string(b.Get([]byte(key)))
-		return nil
-	})
-	return
+// set the body to binary data, base64 encoded for the trip to the acceptor
+func (resp *ResponseInfo) SetBytes(body []byte) {
+	resp.Body = base64.StdEncoding.EncodeToString(body)
+	resp.Encoding = "base64"
 }
 
-func Delete(bucket string, key string) (err error) {
-	db, err := bolt.Open("red.db", 0600, nil)
-	defer db.Close()
+// send the contents of a file, setting the content type from its extension
+// if the responder hasn't set one
+func (resp *ResponseInfo) SendFile(filename string) (err error) {
+	body, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		if b == nil {
-			return fmt.Errorf("Bucket %q not found!", bucket)
+	if len(resp.Header["Content-Type"]) == 0 {
+		ctype := mime.TypeByExtension(filepath.Ext(filename))
+		if ctype == "" {
+			ctype = http.DetectContentType(body)
 		}
-		b.Delete([]byte(key))
-		return nil
-	})
+		resp.AddHeader("Content-Type", ctype)
+	}
+	resp.SetBytes(body)
 	return
 }
 
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"time"
+)
+
+// responders publish a crash report to this subject when they recover from
+// a panic
+const crashesSubject = "_red.crashes"
+
+// CrashReport describes a panic in a responder while handling a request
+type CrashReport struct {
+	Route     string          `json:"route"`
+	Instance  string          `json:"instance"`
+	RequestID string          `json:"request_id"`
+	Panic     string          `json:"panic"`
+	Stack     string          `json:"stack"`
+	Time      time.Time       `json:"time"`
+	Request   json.RawMessage `json:"request"`
+}
+
+// RequestSummary is the part of the request kept in a crash report
+type RequestSummary struct {
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	Query         string `json:"query"`
+	RemoteAddr    string `json:"remote_addr"`
+	ContentType   string `json:"content_type"`
+	ContentLength int64  `json:"content_length"`
+}
+
+// collect the crash reports published by the responders into the database
+func collectCrashes() (err error) {
+	_, err = conn.Subscribe(crashesSubject, func(msg *nats.Msg) {
+		report := CrashReport{}
+		err := json.Unmarshal(msg.Data, &report)
+		if err != nil || report.Route == "" {
+			warning("Ignoring malformed crash report", err)
+			return
+		}
+		warning("Responder crashed", report.Route, report.Instance, report.RequestID, report.Panic)
+		crash := CrashData{
+			Route:     report.Route,
+			Instance:  report.Instance,
+			RequestID: report.RequestID,
+			Panic:     report.Panic,
+			Stack:     report.Stack,
+			Request:   string(report.Request),
+			CreatedAt: report.Time,
+		}
+		if crash.CreatedAt.IsZero() {
+			crash.CreatedAt = time.Now()
+		}
+		err = crash.Create()
+		if err != nil {
+			danger("Cannot save crash report:", err)
+		}
+	})
+	return
+}
+
+// the request that crashed the responder
+func (c CrashData) Summary() (summary RequestSummary) {
+	json.Unmarshal([]byte(c.Request), &summary)
+	return
+}
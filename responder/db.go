@@ -110,3 +110,65 @@ func (r *SettingsData) Set() (err error) {
 	_, err = Db.NamedExec("UPDATE settings SET queue = :queue, repo = :repo", map[string]interface{}{"repo": r.Repo, "queue": r.Queue})
 	return
 }
+
+//
+// Crashes
+//
+
+type CrashData struct {
+	Id        int       `db:"id"`
+	Route     string    `db:"route"`
+	Instance  string    `db:"instance"`
+	RequestID string    `db:"request_id"`
+	Panic     string    `db:"panic"`
+	Stack     string    `db:"stack"`
+	Request   string    `db:"request"`
+	CreatedAt time.Time `db:"date_created"`
+}
+
+// save a crash report from a responder
+func (c *CrashData) Create() (err error) {
+	err = Db.QueryRowx("insert into crashes (route, instance, request_id, panic, stack, request, date_created) values ($1, $2, $3, $4, $5, $6, $7) returning id",
+		c.Route, c.Instance, c.RequestID, c.Panic, c.Stack, c.Request, c.CreatedAt).Scan(&c.Id)
+	return
+}
+
+// get the most recent crashes of the responders for a route
+func CrashesByRoute(route string, limit int) (crashes []CrashData, err error) {
+	err = Db.Select(&crashes, "SELECT * FROM crashes WHERE route = $1 ORDER BY date_created DESC LIMIT $2", route, limit)
+	return
+}
+
+//
+// Store changes
+//
+
+type KVChange struct {
+	Id        int       `db:"id"`
+	Bucket    string    `db:"bucket"`
+	Key       string    `db:"key"`
+	Action    string    `db:"action"`
+	OldValue  []byte    `db:"old_value"`
+	NewValue  []byte    `db:"new_value"`
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"date_created"`
+}
+
+// record a change made to the store from the control plane
+func (c *KVChange) Create() (err error) {
+	err = Db.QueryRowx("insert into kv_changes (bucket, key, action, old_value, new_value, email) values ($1, $2, $3, $4, $5, $6) returning id, date_created",
+		c.Bucket, c.Key, c.Action, c.OldValue, c.NewValue, c.Email).Scan(&c.Id, &c.CreatedAt)
+	return
+}
+
+// get the most recent changes to the store
+func KVChanges(limit int) (changes []KVChange, err error) {
+	err = Db.Select(&changes, "SELECT * FROM kv_changes ORDER BY date_created DESC LIMIT $1", limit)
+	return
+}
+
+// get the most recent changes to a key in the store
+func KVChangesByKey(bucket, key string, limit int) (changes []KVChange, err error) {
+	err = Db.Select(&changes, "SELECT * FROM kv_changes WHERE bucket = $1 AND key = $2 ORDER BY date_created DESC LIMIT $3", bucket, key, limit)
+	return
+}
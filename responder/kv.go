@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/nats-io/nats.go"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// responders send their store requests to this subject, the control plane
+// keeps the data in a single bolt file so every responder instance, on any
+// machine, sees the same data
+const kvSubject = "_red.kv"
+
+// the bolt file the store is kept in
+const kvFile = "red.db"
+
+// buckets starting with this prefix are kept for the store itself and
+// can't be used by responders, the expiry times of keys with a TTL are
+// kept in the ttl bucket, keyed by bucket and key
+const (
+	kvReserved  = "_red."
+	kvTTLBucket = "_red.ttl"
+)
+
+// page sizes for listing keys
+const (
+	kvDefaultLimit = 100
+	kvMaxLimit     = 1000
+)
+
+// room left in a reply for everything but the listed entries, and the
+// most an entry adds besides its key and value
+const (
+	kvReplyMargin = 1024
+	kvEntryMargin = 32
+)
+
+// the largest reply the NATS server takes, a page of keys stops before it
+func kvReplyBudget() int {
+	max := 1 << 20
+	if conn != nil && conn.MaxPayload() > 0 {
+		max = int(conn.MaxPayload())
+	}
+	return max - kvReplyMargin
+}
+
+// the store, opened once by the control plane
+var kv *bolt.DB
+
+// errConflict fails a compare-and-swap or a batch whose expected values
+// don't match
+var errConflict = errors.New("conflict")
+
+// KVRequest is a request to the store from a responder
+// TTL is in milliseconds, the key expires after it
+// Check is the condition for cas and for batches, "value" if the key must
+// have the Expect value and "absent" if it must not exist
+// a batch carries its operations in Ops, which are all done or none are
+type KVRequest struct {
+	Op     string      `json:"op"`
+	Bucket string      `json:"bucket"`
+	Key    string      `json:"key"`
+	Value  []byte      `json:"value,omitempty"`
+	TTL    int64       `json:"ttl,omitempty"`
+	Prefix string      `json:"prefix,omitempty"`
+	Cursor string      `json:"cursor,omitempty"`
+	Limit  int         `json:"limit,omitempty"`
+	Check  string      `json:"check,omitempty"`
+	Expect []byte      `json:"expect,omitempty"`
+	Delta  int64       `json:"delta,omitempty"`
+	Ops    []KVRequest `json:"ops,omitempty"`
+}
+
+// KVEntry is a key and its value
+type KVEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// KVReply is the store's reply to a request
+type KVReply struct {
+	Value    []byte    `json:"value,omitempty"`
+	Found    bool      `json:"found"`
+	Entries  []KVEntry `json:"entries,omitempty"`
+	Next     string    `json:"next,omitempty"`
+	Number   int64     `json:"number,omitempty"`
+	Conflict bool      `json:"conflict,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// open the store and answer the store requests from the responders
+func serveKV() (err error) {
+	kv, err = bolt.Open(kvFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return
+	}
+	_, err = conn.Subscribe(kvSubject, func(msg *nats.Msg) {
+		req := KVRequest{}
+		reply := KVReply{}
+		err := json.Unmarshal(msg.Data, &req)
+		if err != nil {
+			reply.Error = "malformed request: " + err.Error()
+		} else {
+			reply = handleKV(req)
+		}
+		data, _ := json.Marshal(reply)
+		err = msg.Respond(data)
+		if err != nil {
+			warning("Cannot reply to store request", req.Op, req.Bucket, req.Key, err)
+			// let the responder know rather than leave it waiting
+			data, _ = json.Marshal(KVReply{Error: "cannot send reply: " + err.Error()})
+			msg.Respond(data)
+		}
+	})
+	if err != nil {
+		return
+	}
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			n, err := expireKeys(now)
+			if err != nil {
+				danger("Cannot expire keys:", err)
+			} else if n > 0 {
+				info("Expired", n, "keys")
+			}
+		}
+	}()
+	return
+}
+
+// carry out a store request
+func handleKV(req KVRequest) (reply KVReply) {
+	var err error
+	switch req.Op {
+	case "get":
+		err = checkBucket(req.Bucket)
+		if err == nil {
+			err = kv.View(func(tx *bolt.Tx) error {
+				reply.Value, reply.Found = kvGet(tx, req.Bucket, req.Key, time.Now())
+				return nil
+			})
+		}
+	case "list":
+		err = checkBucket(req.Bucket)
+		if err == nil {
+			err = kv.View(func(tx *bolt.Tx) (err error) {
+				reply.Entries, reply.Next, err = kvList(tx, req.Bucket, req.Prefix, req.Cursor, req.Limit, kvReplyBudget(), time.Now())
+				return
+			})
+		}
+	case "store", "delete", "cas", "incr":
+		err = kv.Update(func(tx *bolt.Tx) error {
+			return kvApply(tx, req, &reply, time.Now())
+		})
+	case "batch":
+		err = kv.Update(func(tx *bolt.Tx) error {
+			now := time.Now()
+			for _, op := range req.Ops {
+				if op.Op == "batch" || op.Op == "get" || op.Op == "list" {
+					return fmt.Errorf("%s can't be part of a batch", op.Op)
+				}
+				err := kvApply(tx, op, &reply, now)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	if err == errConflict {
+		reply = KVReply{Conflict: true}
+	} else if err != nil {
+		reply = KVReply{Error: err.Error()}
+	}
+	return
+}
+
+// check that the bucket can be used by responders
+func checkBucket(bucket string) error {
+	if bucket == "" {
+		return errors.New("bucket is required")
+	}
+	if strings.HasPrefix(bucket, kvReserved) {
+		return fmt.Errorf("bucket %q is reserved", bucket)
+	}
+	return nil
+}
+
+// carry out a change to the store within a transaction, a conflict rolls
+// back the whole transaction
+func kvApply(tx *bolt.Tx, req KVRequest, reply *KVReply, now time.Time) (err error) {
+	err = checkBucket(req.Bucket)
+	if err != nil {
+		return
+	}
+	value, found := kvGet(tx, req.Bucket, req.Key, now)
+	switch req.Check {
+	case "":
+	case "absent":
+		if found {
+			return errConflict
+		}
+	case "value":
+		if !found || !bytes.Equal(value, req.Expect) {
+			return errConflict
+		}
+	default:
+		return fmt.Errorf("unknown check %q", req.Check)
+	}
+	switch req.Op {
+	case "store":
+		err = kvPut(tx, req.Bucket, req.Key, req.Value, req.TTL, now)
+	case "cas":
+		err = kvReplace(tx, req.Bucket, req.Key, req.Value, found, req.TTL, now)
+	case "delete":
+		err = kvDelete(tx, req.Bucket, req.Key)
+	case "incr":
+		var n int64
+		if found {
+			n, err = strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("value of %q is not a number", req.Key)
+			}
+		}
+		n += req.Delta
+		err = kvReplace(tx, req.Bucket, req.Key, []byte(strconv.FormatInt(n, 10)), found, req.TTL, now)
+		reply.Number = n
+	case "check":
+		// a condition in a batch, with nothing to change
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	return
+}
+
+// the key of a key's expiry time in the ttl bucket
+func ttlKey(bucket, key string) []byte {
+	return []byte(bucket + "\x00" + key)
+}
+
+// check if the key has expired
+func expired(tx *bolt.Tx, bucket, key string, now time.Time) bool {
+	ttl := tx.Bucket([]byte(kvTTLBucket))
+	if ttl == nil {
+		return false
+	}
+	v := ttl.Get(ttlKey(bucket, key))
+	return len(v) == 8 && int64(binary.BigEndian.Uint64(v)) <= now.UnixNano()
+}
+
+// get a value, keys that have expired but not been removed yet are missing
+func kvGet(tx *bolt.Tx, bucket, key string, now time.Time) (value []byte, found bool) {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return
+	}
+	v := b.Get([]byte(key))
+	if v == nil || expired(tx, bucket, key, now) {
+		return
+	}
+	return append([]byte{}, v...), true
+}
+
+// put a value, with its expiry time if it has a TTL, storing a value
+// without a TTL removes any earlier expiry time
+func kvPut(tx *bolt.Tx, bucket, key string, value []byte, ttl int64, now time.Time) (err error) {
+	if value == nil {
+		value = []byte{}
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return
+	}
+	err = b.Put([]byte(key), value)
+	if err != nil {
+		return
+	}
+	ttls, err := tx.CreateBucketIfNotExists([]byte(kvTTLBucket))
+	if err != nil {
+		return
+	}
+	if ttl <= 0 {
+		return ttls.Delete(ttlKey(bucket, key))
+	}
+	expiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiry, uint64(now.Add(time.Duration(ttl)*time.Millisecond).UnixNano()))
+	return ttls.Put(ttlKey(bucket, key), expiry)
+}
+
+// change a value, keeping the expiry time of a key that was found unless a
+// new TTL is given, a key that wasn't found may have expired and not been
+// removed yet, so its old expiry time is removed
+func kvReplace(tx *bolt.Tx, bucket, key string, value []byte, found bool, ttl int64, now time.Time) (err error) {
+	if ttl > 0 || !found {
+		return kvPut(tx, bucket, key, value, ttl, now)
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return
+	}
+	return b.Put([]byte(key), value)
+}
+
+// delete a key and its expiry time
+func kvDelete(tx *bolt.Tx, bucket, key string) (err error) {
+	if b := tx.Bucket([]byte(bucket)); b != nil {
+		err = b.Delete([]byte(key))
+		if err != nil {
+			return
+		}
+	}
+	if ttls := tx.Bucket([]byte(kvTTLBucket)); ttls != nil {
+		err = ttls.Delete(ttlKey(bucket, key))
+	}
+	return
+}
+
+// list a page of the keys with the prefix, in key order, starting after
+// the cursor, next is the cursor for the following page or empty if this
+// is the last page, the page also ends before the entries, as JSON, would
+// take more than maxBytes
+func kvList(tx *bolt.Tx, bucket, prefix, cursor string, limit int, maxBytes int, now time.Time) (entries []KVEntry, next string, err error) {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return
+	}
+	if limit <= 0 {
+		limit = kvDefaultLimit
+	}
+	if limit > kvMaxLimit {
+		limit = kvMaxLimit
+	}
+	start := []byte(prefix)
+	if cursor > prefix {
+		start = []byte(cursor)
+	}
+	size := 0
+	c := b.Cursor()
+	for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		if string(k) == cursor || expired(tx, bucket, string(k), now) {
+			continue
+		}
+		// values are base64 encoded, keys may be escaped
+		key, _ := json.Marshal(string(k))
+		entrySize := len(key) + base64.StdEncoding.EncodedLen(len(v)) + kvEntryMargin
+		if len(entries) == limit || len(entries) > 0 && size+entrySize > maxBytes {
+			next = entries[len(entries)-1].Key
+			return
+		}
+		if entrySize > maxBytes {
+			err = fmt.Errorf("value of %q is too large to list, get it on its own", k)
+			return
+		}
+		size += entrySize
+		entries = append(entries, KVEntry{Key: string(k), Value: append([]byte{}, v...)})
+	}
+	return
+}
+
+// remove the keys that have expired
+func expireKeys(now time.Time) (n int, err error) {
+	err = kv.Update(func(tx *bolt.Tx) error {
+		ttls := tx.Bucket([]byte(kvTTLBucket))
+		if ttls == nil {
+			return nil
+		}
+		var due [][]byte
+		ttls.ForEach(func(k, v []byte) error {
+			if len(v) == 8 && int64(binary.BigEndian.Uint64(v)) <= now.UnixNano() {
+				due = append(due, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range due {
+			parts := strings.SplitN(string(k), "\x00", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			err := kvDelete(tx, parts[0], parts[1])
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testKV(t *testing.T) {
+	var err error
+	kv, err = bolt.Open(filepath.Join(t.TempDir(), "red.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.Close() })
+}
+
+func TestKVStoreGetDelete(t *testing.T) {
+	testKV(t)
+	reply := handleKV(KVRequest{Op: "get", Bucket: "carts", Key: "alice"})
+	if reply.Error != "" || reply.Found {
+		t.Error("get from a missing bucket should find nothing:", reply)
+	}
+	reply = handleKV(KVRequest{Op: "store", Bucket: "carts", Key: "alice", Value: []byte("3 apples")})
+	if reply.Error != "" {
+		t.Fatal(reply.Error)
+	}
+	reply = handleKV(KVRequest{Op: "get", Bucket: "carts", Key: "alice"})
+	if !reply.Found || string(reply.Value) != "3 apples" {
+		t.Error("wrong value:", reply)
+	}
+	handleKV(KVRequest{Op: "delete", Bucket: "carts", Key: "alice"})
+	reply = handleKV(KVRequest{Op: "get", Bucket: "carts", Key: "alice"})
+	if reply.Found {
+		t.Error("deleted key still found")
+	}
+}
+
+func TestKVListPages(t *testing.T) {
+	testKV(t)
+	for i := 0; i < 5; i++ {
+		handleKV(KVRequest{Op: "store", Bucket: "carts", Key: fmt.Sprintf("alice/%d", i), Value: []byte("x")})
+	}
+	handleKV(KVRequest{Op: "store", Bucket: "carts", Key: "bob/0", Value: []byte("x")})
+	var keys []string
+	cursor := ""
+	pages := 0
+	for {
+		reply := handleKV(KVRequest{Op: "list", Bucket: "carts", Prefix: "alice/", Cursor: cursor, Limit: 2})
+		if reply.Error != "" {
+			t.Fatal(reply.Error)
+		}
+		pages++
+		for _, e := range reply.Entries {
+			keys = append(keys, e.Key)
+		}
+		if cursor = reply.Next; cursor == "" {
+			break
+		}
+	}
+	if fmt.Sprint(keys) != "[alice/0 alice/1 alice/2 alice/3 alice/4]" || pages != 3 {
+		t.Error("wrong keys:", keys, pages)
+	}
+}
+
+func TestKVExpiry(t *testing.T) {
+	testKV(t)
+	handleKV(KVRequest{Op: "store", Bucket: "carts", Key: "alice", Value: []byte("x"), TTL: 1})
+	handleKV(KVRequest{Op: "store", Bucket: "carts", Key: "bob", Value: []byte("y"), TTL: 60000})
+	time.Sleep(5 * time.Millisecond)
+	if reply := handleKV(KVRequest{Op: "get", Bucket: "carts", Key: "alice"}); reply.Found {
+		t.Error("expired key still found")
+	}
+	n, err := expireKeys(time.Now())
+	if err != nil || n != 1 {
+		t.Error("wrong number of keys expired:", n, err)
+	}
+	if reply := handleKV(KVRequest{Op: "get", Bucket: "carts", Key: "bob"}); !reply.Found {
+		t.Error("key expired early")
+	}
+}
+
+func TestKVKeepTTL(t *testing.T) {
+	testKV(t)
+	hasTTL := func(key string) (found bool) {
+		kv.View(func(tx *bolt.Tx) error {
+			found = tx.Bucket([]byte(kvTTLBucket)).Get(ttlKey("hits", key)) != nil
+			return nil
+		})
+		return
+	}
+	handleKV(KVRequest{Op: "store", Bucket: "hits", Key: "today", Value: []byte("1"), TTL: 60000})
+	handleKV(KVRequest{Op: "incr", Bucket: "hits", Key: "today", Delta: 1})
+	handleKV(KVRequest{Op: "cas", Bucket: "hits", Key: "today", Value: []byte("5"), Check: "value", Expect: []byte("2")})
+	if !hasTTL("today") {
+		t.Error("incr or cas removed the expiry time")
+	}
+	// a key that expired but wasn't removed starts again without one
+	handleKV(KVRequest{Op: "store", Bucket: "hits", Key: "minute", Value: []byte("7"), TTL: 1})
+	time.Sleep(5 * time.Millisecond)
+	reply := handleKV(KVRequest{Op: "incr", Bucket: "hits", Key: "minute", Delta: 1})
+	if reply.Number != 1 || hasTTL("minute") {
+		t.Error("expired key kept its expiry time:", reply)
+	}
+}
+
+func TestKVCompareAndSwap(t *testing.T) {
+	testKV(t)
+	reply := handleKV(KVRequest{Op: "cas", Bucket: "stock", Key: "apples", Value: []byte("3"), Check: "absent"})
+	if reply.Conflict || reply.Error != "" {
+		t.Fatal("cas on a new key failed:", reply)
+	}
+	reply = handleKV(KVRequest{Op: "cas", Bucket: "stock", Key: "apples", Value: []byte("5"), Check: "value", Expect: []byte("4")})
+	if !reply.Conflict {
+		t.Error("cas with a stale value should conflict")
+	}
+	reply = handleKV(KVRequest{Op: "incr", Bucket: "stock", Key: "apples", Delta: -1})
+	if reply.Number != 2 {
+		t.Error("wrong count:", reply)
+	}
+}
+
+func TestKVBatch(t *testing.T) {
+	testKV(t)
+	handleKV(KVRequest{Op: "store", Bucket: "stock", Key: "apples", Value: []byte("1")})
+	batch := KVRequest{Op: "batch", Ops: []KVRequest{
+		{Op: "store", Bucket: "carts", Key: "alice", Value: []byte("apples")},
+		{Op: "check", Bucket: "stock", Key: "apples", Check: "value", Expect: []byte("2")},
+	}}
+	if reply := handleKV(batch); !reply.Conflict {
+		t.Fatal("batch should conflict:", reply)
+	}
+	if reply := handleKV(KVRequest{Op: "get", Bucket: "carts", Key: "alice"}); reply.Found {
+		t.Error("failed batch was not rolled back")
+	}
+	batch.Ops[1].Expect = []byte("1")
+	if reply := handleKV(batch); reply.Conflict || reply.Error != "" {
+		t.Fatal("batch failed:", reply)
+	}
+	if reply := handleKV(KVRequest{Op: "get", Bucket: "carts", Key: "alice"}); !reply.Found {
+		t.Error("batch was not committed")
+	}
+}
+
+func TestKVListPageSize(t *testing.T) {
+	testKV(t)
+	value := make([]byte, 3000)
+	for i := 0; i < 10; i++ {
+		handleKV(KVRequest{Op: "store", Bucket: "files", Key: fmt.Sprintf("f%d", i), Value: value})
+	}
+	kv.View(func(tx *bolt.Tx) error {
+		entries, next, err := kvList(tx, "files", "", "", 100, 10000, time.Now())
+		if err != nil || len(entries) != 2 || next != "f1" {
+			t.Error("page not cut short:", len(entries), next, err)
+		}
+		_, _, err = kvList(tx, "files", "", "", 100, 1000, time.Now())
+		if err == nil {
+			t.Error("value larger than a reply should fail")
+		}
+		return nil
+	})
+}
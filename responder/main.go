@@ -9,6 +9,28 @@ import (
 )
 
 func main() {
+	err := connectQueue()
+	if err != nil {
+		danger("Cannot connect to NATS server:", err)
+	} else {
+		err = collectTraces()
+		if err != nil {
+			danger("Cannot collect traces:", err)
+		}
+		err = collectTimings()
+		if err != nil {
+			danger("Cannot collect timings:", err)
+		}
+		err = collectCrashes()
+		if err != nil {
+			danger("Cannot collect crash reports:", err)
+		}
+		err = serveKV()
+		if err != nil {
+			danger("Cannot serve the store:", err)
+		}
+	}
+
 	router := httprouter.New()
 	addr := "0.0.0.0:8088"
 	router.ServeFiles("/static/*filepath", http.Dir("public"))
@@ -34,7 +56,15 @@ func main() {
 	router.POST("/responders/responder/start", responderStart)
 	router.GET("/responders/responder/build", responderBuild)
 	router.GET("/responders/responder/stop", responderStop)
+	router.GET("/responders/responder/restart", responderRestart)
 	router.GET("/files", files)
+	router.GET("/traces", traces)
+	router.GET("/traces/trace", trace)
+	router.GET("/store", loggedIn(store))
+	router.GET("/store/bucket", loggedIn(storeBucket))
+	router.GET("/store/key", loggedIn(storeKey))
+	router.POST("/store/key", loggedIn(storeKeySave))
+	router.POST("/store/key/delete", loggedIn(storeKeyDelete))
 	fmt.Println("Polyglot Responder v0.2 started at", addr)
 	server.ListenAndServe()
 
@@ -64,16 +94,24 @@ func responder(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	path := r.FormValue("path")
 	lang := r.FormValue("lang")
 	t, _ := template.ParseFiles("html/responder.html", "html/nav.html")
+	crashes, err := CrashesByRoute(id, 20)
+	if err != nil {
+		danger("Cannot get crashes:", err)
+	}
 	data := struct {
-		ID       string
-		Path     string
-		Language string
-		Count    int
+		ID        string
+		Path      string
+		Language  string
+		Count     int
+		Analytics Analytics
+		Crashes   []CrashData
 	}{
 		id,
 		path,
 		lang,
-		len(ProcessMap[id]),
+		instanceCount(id),
+		routeAnalytics(responderRoutes(id)),
+		crashes,
 	}
 	t.Execute(w, data)
 }
@@ -115,6 +153,19 @@ func responderStop(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	http.Redirect(w, r, "/responders/responder?id="+id, 302)
 }
 
+func responderRestart(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id := r.FormValue("id")
+	lang := r.FormValue("lang")
+	info("Restarting responder", id)
+	settings := SettingsData{}
+	settings.Get()
+	err := restartProcess(id, lang, settings.Queue)
+	if err != nil {
+		danger("Cannot restart responder", id)
+	}
+	http.Redirect(w, r, "/responders/responder?id="+id, 302)
+}
+
 func responders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	t, _ := template.ParseFiles("html/responders.html", "html/nav.html")
 	repo, err := repo()
@@ -140,7 +191,7 @@ func responders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 	for i, group := range data.Manifest.Groups {
 		for j, r := range group.Responders {
-			data.Manifest.Groups[i].Responders[j].Count = len(ProcessMap[r.ID])
+			data.Manifest.Groups[i].Responders[j].Count = instanceCount(r.ID)
 		}
 	}
 
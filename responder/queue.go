@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+// the control plane's connection to the NATS server, used to collect what
+// the acceptor and the responders report
+var conn *nats.Conn
+
+// connect to the NATS server in the settings, or the default server if
+// it's not set, retrying in the background until the server is up
+func connectQueue() (err error) {
+	settings := SettingsData{}
+	err = settings.Get()
+	if err != nil {
+		danger("Cannot get settings:", err)
+	}
+	url := settings.Queue
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	conn, err = nats.Connect(url,
+		nats.Name("red control plane"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	)
+	return
+}
@@ -2,38 +2,198 @@ package main
 
 import (
 	"os"
+	"sync"
+	"syscall"
+	"time"
 )
 
-var ProcessMap map[string][]*os.Process
+// responders are given this long to finish their requests after SIGTERM
+// before they are killed
+const stopTimeout = 15 * time.Second
+
+// responders are told to finish draining this long before they would be
+// killed, so they have time to flush their replies and exit
+const shutdownMargin = 3 * time.Second
+
+// Instance is a running responder process
+type Instance struct {
+	*os.Process
+	exited chan struct{}
+}
+
+// the running instances of each responder, the HTTP handlers change it at
+// the same time so it is only used with the lock held
+var ProcessMap map[string][]*Instance
+var processes sync.Mutex
 
 func init() {
-	ProcessMap = make(map[string][]*os.Process)
+	ProcessMap = make(map[string][]*Instance)
+}
+
+// the number of running instances of a responder
+func instanceCount(id string) int {
+	processes.Lock()
+	defer processes.Unlock()
+	return len(ProcessMap[id])
+}
+
+// the running instances of a responder, left in the map
+func instancesOf(id string) []*Instance {
+	processes.Lock()
+	defer processes.Unlock()
+	return append([]*Instance{}, ProcessMap[id]...)
+}
+
+func addInstance(id string, instance *Instance) {
+	processes.Lock()
+	defer processes.Unlock()
+	ProcessMap[id] = append(ProcessMap[id], instance)
+}
+
+// take an instance out of the map, returns false if it isn't there because
+// it has exited or something else is stopping it
+func removeInstance(id string, instance *Instance) bool {
+	processes.Lock()
+	defer processes.Unlock()
+	for i, in := range ProcessMap[id] {
+		if in == instance {
+			ProcessMap[id] = append(ProcessMap[id][:i:i], ProcessMap[id][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// take all the instances of a responder out of the map, to stop them
+func takeInstances(id string) []*Instance {
+	processes.Lock()
+	defer processes.Unlock()
+	instances := ProcessMap[id]
+	ProcessMap[id] = []*Instance{}
+	return instances
+}
+
+// stop a responder instance, asking it to shut down with SIGTERM first and
+// killing it if it hasn't exited by the timeout
+func (instance *Instance) stop(id string) (err error) {
+	err = instance.Signal(syscall.SIGTERM)
+	if err != nil {
+		select {
+		case <-instance.exited:
+			return nil
+		default:
+		}
+		warning("Cannot send SIGTERM to responder", id, instance.Pid, err)
+	} else {
+		select {
+		case <-instance.exited:
+			info("Responder stopped", id, instance.Pid)
+			return
+		case <-time.After(stopTimeout):
+			warning("Responder did not stop in time, killing it", id, instance.Pid)
+		}
+	}
+	err = instance.Kill()
+	if err != nil {
+		return
+	}
+	<-instance.exited
+	return
 }
 
+// stop all the instances of a responder at the same time
 func stopProcess(id string) (err error) {
 	info("Stopping process", id)
-	for _, process := range ProcessMap[id] {
-		err = process.Kill()
+	return stopInstances(id, takeInstances(id))
+}
+
+func stopInstances(id string, instances []*Instance) (err error) {
+	errs := make(chan error, len(instances))
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance *Instance) {
+			defer wg.Done()
+			errs <- instance.stop(id)
+		}(instance)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		if e != nil {
+			danger("Cannot stop process", id, e)
+			err = e
+		}
+	}
+	return
+}
+
+func stopAll() {
+	processes.Lock()
+	all := ProcessMap
+	ProcessMap = make(map[string][]*Instance)
+	processes.Unlock()
+	var wg sync.WaitGroup
+	for id, instances := range all {
+		info("Stopping process", id)
+		wg.Add(1)
+		go func(id string, instances []*Instance) {
+			defer wg.Done()
+			stopInstances(id, instances)
+		}(id, instances)
+	}
+	wg.Wait()
+}
+
+// restart the instances of a responder one at a time, starting a new
+// instance before stopping an old one so the route is never left without
+// a responder, the old instances stay in the map until they are stopped so
+// a stop in the meantime still finds them
+func restartProcess(id, lang string, queue string) (err error) {
+	info("Restarting process", id)
+	for _, instance := range instancesOf(id) {
+		if !tracked(id, instance) {
+			// stopped or exited since the restart began
+			continue
+		}
+		if !runProcess(id, lang, queue) {
+			// keep the old instances running if new ones can't start
+			continue
+		}
+		// give the new instance time to subscribe before the old one leaves
+		time.Sleep(time.Second)
+		if !removeInstance(id, instance) {
+			continue
+		}
+		err = instance.stop(id)
 		if err != nil {
 			danger("Cannot stop process", id, err)
-			return
 		}
 	}
-	ProcessMap[id] = []*os.Process{}
 	return
 }
 
-func stopAll() {
-	for id, _ := range ProcessMap {
-		stopProcess(id)
+// check if the instance is still in the map
+func tracked(id string, instance *Instance) bool {
+	processes.Lock()
+	defer processes.Unlock()
+	for _, in := range ProcessMap[id] {
+		if in == instance {
+			return true
+		}
 	}
+	return false
 }
 
 // run the responder as a separate process
-func runProcess(id, lang string, queue string) {
+func runProcess(id, lang string, queue string) (ok bool) {
 	var procAttr os.ProcAttr
 	procAttr.Files = []*os.File{nil, os.Stdout, os.Stderr}
-	procAttr.Env = []string{"ID=" + id, "QUEUE=" + queue}
+	procAttr.Env = []string{
+		"ID=" + id,
+		"QUEUE=" + queue,
+		"SHUTDOWN_TIMEOUT=" + (stopTimeout - shutdownMargin).String(),
+	}
 
 	if lang == "ruby" {
 		procAttr.Env = append(procAttr.Env, "PATH="+os.Getenv("RUBY"))
@@ -44,9 +204,20 @@ func runProcess(id, lang string, queue string) {
 		danger("Cannot start responder", err)
 		return
 	} else {
-		ProcessMap[id] = append(ProcessMap[id], proc)
+		instance := &Instance{Process: proc, exited: make(chan struct{})}
+		addInstance(id, instance)
+		// wait for the process so it is reaped when it exits, and stop
+		// tracking it if it exits by itself
+		go func() {
+			proc.Wait()
+			close(instance.exited)
+			if removeInstance(id, instance) {
+				warning("Responder exited", id, proc.Pid)
+			}
+		}()
 	}
-	info(ProcessMap)
+	info("Started responder", id, proc.Pid, "-", instanceCount(id), "running")
+	return true
 }
 
 // run all responders
@@ -54,7 +225,7 @@ func runAll(queue string) (err error) {
 	manifest, err := getManifest()
 	for _, group := range manifest.Groups {
 		for _, r := range group.Responders {
-			if len(ProcessMap[r.ID]) < 1 {
+			if instanceCount(r.ID) < 1 {
 				runProcess(r.ID, group.Language, queue)
 			}
 		}
@@ -21,3 +21,29 @@ CREATE TABLE settings (
 	repo varchar(255)
 );
 
+
+CREATE TABLE crashes (
+	id serial primary key,
+	route varchar(255) not null,
+	instance varchar(255),
+	request_id varchar(255),
+	panic text,
+	stack text,
+	request text,
+	date_created timestamp default CURRENT_TIMESTAMP
+);
+
+CREATE INDEX crashes_route ON crashes (route, date_created);
+
+CREATE TABLE kv_changes (
+	id serial primary key,
+	bucket varchar(255) not null,
+	key text not null,
+	action varchar(16) not null,
+	old_value bytea not null,
+	new_value bytea not null,
+	email varchar(255) not null,
+	date_created timestamp default CURRENT_TIMESTAMP
+);
+
+CREATE INDEX kv_changes_key ON kv_changes (bucket, key, date_created);
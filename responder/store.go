@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// keys shown on each page of a bucket
+const storePageSize = 50
+
+// values longer than this are cut short in the list of keys
+const previewSize = 80
+
+// BucketInfo is a bucket in the store and the number of keys in it
+type BucketInfo struct {
+	Name string
+	Keys int
+}
+
+// StoreEntry is a key in the store shown in the browser
+type StoreEntry struct {
+	Bucket  string
+	Key     string
+	Value   []byte
+	Expires time.Time
+}
+
+// the value for the list of keys, as text if it can be, cut short
+func (e StoreEntry) Preview() string {
+	s := string(e.Value)
+	if !utf8.Valid(e.Value) {
+		s = hex.EncodeToString(e.Value)
+	}
+	if r := []rune(s); len(r) > previewSize {
+		s = string(r[:previewSize]) + "…"
+	}
+	return s
+}
+
+// the value as text, JSON or hex, the view is changed to one the value can
+// be shown in
+func (e StoreEntry) Format(view string) (shown string, as string) {
+	if view == "" {
+		view = "text"
+		if json.Valid(e.Value) {
+			view = "json"
+		}
+	}
+	if view == "json" {
+		var buf bytes.Buffer
+		if json.Indent(&buf, e.Value, "", "  ") == nil {
+			return buf.String(), "json"
+		}
+		view = "text"
+	}
+	if view == "text" && utf8.Valid(e.Value) {
+		return string(e.Value), "text"
+	}
+	return hex.Dump(e.Value), "hex"
+}
+
+// the buckets responders can use, with their key counts
+func storeBuckets() (buckets []BucketInfo, err error) {
+	if kv == nil {
+		return nil, errors.New("the store is not open")
+	}
+	err = kv.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if !strings.HasPrefix(string(name), kvReserved) {
+				buckets = append(buckets, BucketInfo{Name: string(name), Keys: b.Stats().KeyN})
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// get an entry with its expiry time, if it has one
+func storeEntry(bucket, key string) (entry StoreEntry, found bool, err error) {
+	if kv == nil {
+		err = errors.New("the store is not open")
+		return
+	}
+	entry = StoreEntry{Bucket: bucket, Key: key}
+	err = kv.View(func(tx *bolt.Tx) error {
+		entry.Value, found = kvGet(tx, bucket, key, time.Now())
+		if ttls := tx.Bucket([]byte(kvTTLBucket)); found && ttls != nil {
+			if v := ttls.Get(ttlKey(bucket, key)); len(v) == 8 {
+				entry.Expires = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// change or delete an entry and record the change, a nil value deletes it,
+// the entry keeps its expiry time when it is changed
+// the change is recorded after the bolt transaction commits, so responders
+// using the store don't wait on the database, a change that can't be
+// recorded is still made and reported as an error
+func changeEntry(bucket, key string, value []byte, email string) (err error) {
+	if kv == nil {
+		return errors.New("the store is not open")
+	}
+	err = checkBucket(bucket)
+	if err != nil {
+		return
+	}
+	change := KVChange{Bucket: bucket, Key: key, Email: email, NewValue: []byte{}}
+	err = kv.Update(func(tx *bolt.Tx) (err error) {
+		now := time.Now()
+		old, found := kvGet(tx, bucket, key, now)
+		change.OldValue = append([]byte{}, old...)
+		switch {
+		case value == nil && !found:
+			return errors.New("no such key")
+		case value == nil:
+			change.Action = "delete"
+			return kvDelete(tx, bucket, key)
+		default:
+			change.Action = "create"
+			if found {
+				change.Action = "update"
+			}
+			change.NewValue = value
+			return kvReplace(tx, bucket, key, value, found, 0, now)
+		}
+	})
+	if err != nil {
+		return
+	}
+	info("Store", change.Action, bucket, key, "by", email)
+	err = change.Create()
+	if err != nil {
+		danger("Cannot record store change:", err)
+		return errors.New("the change was made but can't be recorded")
+	}
+	return
+}
+
+// find a page of the keys with the prefix that contain the text, in key
+// order, starting after the cursor, for the browser
+func findKeys(tx *bolt.Tx, bucket, prefix, contains, cursor string, now time.Time) (entries []StoreEntry, next string) {
+	b := tx.Bucket([]byte(bucket))
+	if b == nil {
+		return
+	}
+	start := []byte(prefix)
+	if cursor > prefix {
+		start = []byte(cursor)
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		if string(k) == cursor || !strings.Contains(string(k), contains) || expired(tx, bucket, string(k), now) {
+			continue
+		}
+		if len(entries) == storePageSize {
+			next = entries[len(entries)-1].Key
+			return
+		}
+		entries = append(entries, StoreEntry{Bucket: bucket, Key: string(k), Value: append([]byte{}, v...)})
+	}
+	return
+}
+
+// list the buckets in the store and the latest changes
+func store(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	t, _ := template.ParseFiles("html/store.html", "html/store_changes.html", "html/nav.html")
+	buckets, err := storeBuckets()
+	if err != nil {
+		danger("Cannot list buckets:", err)
+	}
+	changes, e := KVChanges(20)
+	if e != nil {
+		danger("Cannot get store changes:", e)
+	}
+	data := struct {
+		Buckets []BucketInfo
+		Changes []KVChange
+		Error   error
+	}{
+		buckets,
+		changes,
+		err,
+	}
+	t.Execute(w, data)
+}
+
+// browse the keys in a bucket a page at a time, optionally only the keys
+// with a prefix or containing some text
+func storeBucket(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	name := r.FormValue("name")
+	prefix := r.FormValue("prefix")
+	contains := r.FormValue("contains")
+	cursor := r.FormValue("cursor")
+	if kv == nil || checkBucket(name) != nil {
+		http.NotFound(w, r)
+		return
+	}
+	t, _ := template.ParseFiles("html/store_bucket.html", "html/nav.html")
+	var list []StoreEntry
+	var next string
+	kv.View(func(tx *bolt.Tx) error {
+		list, next = findKeys(tx, name, prefix, contains, cursor, time.Now())
+		return nil
+	})
+	data := struct {
+		Name     string
+		Prefix   string
+		Contains string
+		Cursor   string
+		Next     string
+		Entries  []StoreEntry
+		Error    string
+	}{
+		name,
+		prefix,
+		contains,
+		cursor,
+		next,
+		list,
+		r.FormValue("error"),
+	}
+	t.Execute(w, data)
+}
+
+// show an entry, with its value as text, JSON or hex, and its changes
+func storeKey(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	bucket := r.FormValue("bucket")
+	key := r.FormValue("key")
+	entry, found, err := storeEntry(bucket, key)
+	if err != nil || !found || checkBucket(bucket) != nil {
+		http.NotFound(w, r)
+		return
+	}
+	t, _ := template.ParseFiles("html/store_key.html", "html/store_changes.html", "html/nav.html")
+	value, view := entry.Format(r.FormValue("view"))
+	// values that aren't text are edited as hex
+	edit, encoding := string(entry.Value), "text"
+	if !utf8.Valid(entry.Value) {
+		edit, encoding = hex.EncodeToString(entry.Value), "hex"
+	}
+	changes, err := KVChangesByKey(bucket, key, 20)
+	if err != nil {
+		danger("Cannot get store changes:", err)
+	}
+	data := struct {
+		Entry    StoreEntry
+		Value    string
+		View     string
+		Edit     string
+		Encoding string
+		Changes  []KVChange
+		Error    string
+	}{
+		entry,
+		value,
+		view,
+		edit,
+		encoding,
+		changes,
+		r.FormValue("error"),
+	}
+	t.Execute(w, data)
+}
+
+// create or change an entry, the value is given as text or hex
+func storeKeySave(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	email := p.ByName("email")
+	bucket := r.PostFormValue("bucket")
+	key := r.PostFormValue("key")
+	var value []byte
+	var err error
+	if r.PostFormValue("encoding") == "hex" {
+		value, err = hex.DecodeString(strings.Join(strings.Fields(r.PostFormValue("value")), ""))
+	} else {
+		original, _, _ := storeEntry(bucket, key)
+		value = textValue(r.PostFormValue("value"), original.Value)
+	}
+	if err == nil && key == "" {
+		err = errors.New("key is required")
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	if err == nil {
+		err = changeEntry(bucket, key, value, email)
+	}
+	to := "/store/key?bucket=" + url.QueryEscape(bucket) + "&key=" + url.QueryEscape(key)
+	if err != nil {
+		danger("Cannot save", bucket, key, err)
+		// go back to the bucket if the key wasn't created
+		if _, found, _ := storeEntry(bucket, key); !found {
+			to = "/store/bucket?name=" + url.QueryEscape(bucket)
+		}
+		to += "&error=" + url.QueryEscape(err.Error())
+	}
+	http.Redirect(w, r, to, 302)
+}
+
+// the value of an entry edited as text, browsers send the text with CRLF
+// line endings, which are only kept if the value had them before
+func textValue(text string, original []byte) []byte {
+	if !bytes.Contains(original, []byte("\r")) {
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+	}
+	return []byte(text)
+}
+
+// delete an entry
+func storeKeyDelete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	email := p.ByName("email")
+	bucket := r.PostFormValue("bucket")
+	key := r.PostFormValue("key")
+	err := changeEntry(bucket, key, nil, email)
+	if err != nil {
+		danger("Cannot delete", bucket, key, err)
+	}
+	http.Redirect(w, r, "/store/bucket?name="+url.QueryEscape(bucket), 302)
+}
+
+// the values before and after a change, cut short
+func (c KVChange) OldPreview() string {
+	return StoreEntry{Value: c.OldValue}.Preview()
+}
+
+func (c KVChange) NewPreview() string {
+	return StoreEntry{Value: c.NewValue}.Preview()
+}
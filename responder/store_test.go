@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"testing"
+	"time"
+)
+
+func TestStoreEntryFormat(t *testing.T) {
+	tests := []struct {
+		value []byte
+		view  string
+		as    string
+	}{
+		{[]byte(`{"apples":3}`), "", "json"},
+		{[]byte(`{"apples":3}`), "text", "text"},
+		{[]byte("3 apples"), "json", "text"},
+		{[]byte("3 apples"), "hex", "hex"},
+		{[]byte{0xff, 0xfe}, "text", "hex"},
+	}
+	for _, test := range tests {
+		_, as := StoreEntry{Value: test.value}.Format(test.view)
+		if as != test.as {
+			t.Errorf("%q in the %q view shown as %q, want %q", test.value, test.view, as, test.as)
+		}
+	}
+}
+
+func TestFindKeys(t *testing.T) {
+	testKV(t)
+	for _, key := range []string{"alice/apples", "alice/pears", "bob/apples", "carol/plums"} {
+		handleKV(KVRequest{Op: "store", Bucket: "carts", Key: key, Value: []byte("1")})
+	}
+	kv.View(func(tx *bolt.Tx) error {
+		entries, next := findKeys(tx, "carts", "", "apples", "", time.Now())
+		if len(entries) != 2 || entries[0].Key != "alice/apples" || entries[1].Key != "bob/apples" || next != "" {
+			t.Error("wrong keys found:", entries, next)
+		}
+		entries, _ = findKeys(tx, "carts", "alice/", "pe", "", time.Now())
+		if len(entries) != 1 || entries[0].Key != "alice/pears" {
+			t.Error("wrong keys found:", entries)
+		}
+		return nil
+	})
+}
+
+func TestTextValue(t *testing.T) {
+	tests := []struct {
+		text     string
+		original string
+		want     string
+	}{
+		{"a\r\nb", "", "a\nb"},
+		{"a\r\nb", "a\nb", "a\nb"},
+		{"a\r\nb", "a\r\nc", "a\r\nb"},
+		{"a\rb", "", "a\rb"},
+	}
+	for _, test := range tests {
+		if got := string(textValue(test.text, []byte(test.original))); got != test.want {
+			t.Errorf("%q over %q: got %q", test.text, test.original, got)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats.go"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// spans from the acceptor and the responders are collected into this file,
+// one OTLP JSON export request per line, rolling over at maxTracesSize
+const (
+	tracesFile    = "traces.jsonl"
+	maxTracesSize = 50 << 20
+)
+
+// only the end of the traces file is read back for the browser, the most
+// recent traces are there
+const tracesTail = 4 << 20
+
+// exports waiting to be forwarded to the collector, more than this and
+// they are dropped rather than held while the collector is slow
+const forwardQueueSize = 100
+
+var tracesMutex sync.Mutex
+
+// collect the spans published by the acceptor and responders, writing them
+// to the traces file, and forwarding them to an OTLP collector if one is
+// set in OTEL_EXPORTER_OTLP_ENDPOINT
+func collectTraces() (err error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	queue := make(chan []byte, forwardQueueSize)
+	if endpoint != "" {
+		go forwardTraces(endpoint, queue)
+	}
+	_, err = conn.Subscribe("_red.traces", func(msg *nats.Msg) {
+		err := writeTraces(msg.Data)
+		if err != nil {
+			danger("Cannot write traces:", err)
+		}
+		if endpoint == "" {
+			return
+		}
+		select {
+		case queue <- msg.Data:
+		default:
+			warning("Collector is falling behind, dropping traces")
+		}
+	})
+	return
+}
+
+func writeTraces(data []byte) (err error) {
+	tracesMutex.Lock()
+	defer tracesMutex.Unlock()
+	if fi, e := os.Stat(tracesFile); e == nil && fi.Size() > maxTracesSize {
+		err = os.Rename(tracesFile, tracesFile+".1")
+		if err != nil {
+			return
+		}
+	}
+	file, err := os.OpenFile(tracesFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return
+}
+
+// send the queued spans to an OTLP/HTTP collector, one export at a time
+func forwardTraces(endpoint string, queue <-chan []byte) {
+	client := http.Client{Timeout: 10 * time.Second}
+	for data := range queue {
+		resp, err := client.Post(endpoint+"/v1/traces", "application/json", bytes.NewReader(data))
+		if err != nil {
+			warning("Cannot forward traces:", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			warning("Collector rejected traces:", resp.Status)
+		}
+	}
+}
+
+// SpanData is a span read back from the traces file
+type SpanData struct {
+	TraceID           string `json:"traceId"`
+	SpanID            string `json:"spanId"`
+	ParentSpanID      string `json:"parentSpanId"`
+	Name              string `json:"name"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string `json:"endTimeUnixNano"`
+	Attributes        []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+	Status *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+	Service string  `json:"-"`
+	Start   int64   `json:"-"`
+	End     int64   `json:"-"`
+	Depth   int     `json:"-"`
+	Offset  float64 `json:"-"`
+	Width   float64 `json:"-"`
+}
+
+// get an attribute of the span
+func (s *SpanData) Attribute(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue
+		}
+	}
+	return ""
+}
+
+// the duration of the span in milliseconds
+func (s *SpanData) Millis() float64 {
+	return float64(s.End-s.Start) / float64(time.Millisecond)
+}
+
+// Trace is all the spans collected for a trace
+type Trace struct {
+	ID    string
+	Spans []*SpanData
+	Start int64
+	End   int64
+	Root  *SpanData
+}
+
+// the time the trace started
+func (t *Trace) Time() time.Time {
+	return time.Unix(0, t.Start)
+}
+
+// the duration of the trace in milliseconds
+func (t *Trace) Millis() float64 {
+	return float64(t.End-t.Start) / float64(time.Millisecond)
+}
+
+// read the traces collected at the end of the traces file, most recent
+// first, the file is only appended to and renamed, so it is read without
+// holding up the writer and a line still being written is skipped
+func readTraces() (traces []*Trace, err error) {
+	file, err := os.Open(tracesFile)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return
+	}
+	offset := fi.Size() - tracesTail
+	if offset < 0 {
+		offset = 0
+	}
+
+	byId := make(map[string]*Trace)
+	scanner := bufio.NewScanner(io.NewSectionReader(file, offset, fi.Size()-offset))
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	// reading from the middle of the file starts part way through a line
+	if offset > 0 {
+		scanner.Scan()
+	}
+	for scanner.Scan() {
+		export := struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key   string `json:"key"`
+						Value struct {
+							StringValue string `json:"stringValue"`
+						} `json:"value"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []*SpanData `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}{}
+		if json.Unmarshal(scanner.Bytes(), &export) != nil {
+			continue
+		}
+		for _, rs := range export.ResourceSpans {
+			service := ""
+			for _, a := range rs.Resource.Attributes {
+				if a.Key == "service.name" {
+					service = a.Value.StringValue
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					span.Service = service
+					span.Start, _ = strconv.ParseInt(span.StartTimeUnixNano, 10, 64)
+					span.End, _ = strconv.ParseInt(span.EndTimeUnixNano, 10, 64)
+					trace := byId[span.TraceID]
+					if trace == nil {
+						trace = &Trace{ID: span.TraceID, Start: span.Start, End: span.End}
+						byId[span.TraceID] = trace
+						traces = append(traces, trace)
+					}
+					trace.Spans = append(trace.Spans, span)
+					if span.Start < trace.Start {
+						trace.Start = span.Start
+					}
+					if span.End > trace.End {
+						trace.End = span.End
+					}
+				}
+			}
+		}
+	}
+	err = scanner.Err()
+	for _, trace := range traces {
+		trace.layout()
+	}
+	sort.Slice(traces, func(i, j int) bool { return traces[i].Start > traces[j].Start })
+	return
+}
+
+// order the spans of the trace as a tree, and work out where each span is
+// on the trace's timeline, as percentages
+func (t *Trace) layout() {
+	ids := make(map[string]bool)
+	children := make(map[string][]*SpanData)
+	for _, span := range t.Spans {
+		ids[span.SpanID] = true
+	}
+	var roots []*SpanData
+	for _, span := range t.Spans {
+		if span.ParentSpanID == "" || !ids[span.ParentSpanID] {
+			roots = append(roots, span)
+		} else {
+			children[span.ParentSpanID] = append(children[span.ParentSpanID], span)
+		}
+	}
+	byStart := func(spans []*SpanData) {
+		sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+	}
+	total := float64(t.End - t.Start)
+	if total <= 0 {
+		total = 1
+	}
+	var ordered []*SpanData
+	var walk func(spans []*SpanData, depth int)
+	walk = func(spans []*SpanData, depth int) {
+		byStart(spans)
+		for _, span := range spans {
+			span.Depth = depth
+			span.Offset = float64(span.Start-t.Start) / total * 100
+			span.Width = float64(span.End-span.Start) / total * 100
+			ordered = append(ordered, span)
+			walk(children[span.SpanID], depth+1)
+		}
+	}
+	walk(roots, 0)
+	t.Spans = ordered
+	if len(roots) > 0 {
+		t.Root = roots[0]
+	}
+}
+
+// list the most recent traces
+func traces(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	t, _ := template.ParseFiles("html/traces.html", "html/nav.html")
+	list, err := readTraces()
+	if err != nil && !os.IsNotExist(err) {
+		danger("Cannot read traces:", err)
+	}
+	if len(list) > 100 {
+		list = list[:100]
+	}
+	t.Execute(w, list)
+}
+
+// show the spans of a trace on a timeline
+func trace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	id := r.FormValue("id")
+	t, _ := template.ParseFiles("html/trace.html", "html/nav.html")
+	list, err := readTraces()
+	if err != nil && !os.IsNotExist(err) {
+		danger("Cannot read traces:", err)
+	}
+	var found *Trace
+	for _, tr := range list {
+		if tr.ID == id {
+			found = tr
+		}
+	}
+	if found == nil {
+		http.NotFound(w, r)
+		return
+	}
+	t.Execute(w, found)
+}
@@ -0,0 +1,202 @@
+// Package trace records spans in the OTLP JSON format and sends them in
+// batches to the control plane, it is shared by the acceptor and the
+// responders so a request is traced the same way on both sides
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spans are sent in batches to this subject, where the control plane
+// collects them
+const Subject = "_red.traces"
+
+// span kinds, as defined by OTLP
+const (
+	Internal = 1
+	Server   = 2
+	Client   = 3
+)
+
+// the most spans queued before they are sent
+const batchSize = 100
+
+// Span is a timed operation in a trace
+// Start is when the operation started, it is set when the span is started
+// but can be moved earlier, to when a message was received
+type Span struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []Attribute `json:"attributes,omitempty"`
+	Status            *Status     `json:"status,omitempty"`
+	Start             time.Time   `json:"-"`
+}
+
+// Attribute is a key and string value on a span or a resource
+type Attribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// Status marks a span as failed, with a message
+type Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// NewAttribute makes an attribute with a string value
+func NewAttribute(key, value string) (a Attribute) {
+	a.Key = key
+	a.Value.StringValue = value
+	return
+}
+
+// random hex ID of n bytes, for trace and span IDs, crypto/rand only fails
+// if the system has no source of randomness at all
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ParseTraceParent parses a W3C traceparent header into its trace and
+// span IDs
+func ParseTraceParent(header string) (traceId string, spanId string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return
+	}
+	return parts[1], parts[2], true
+}
+
+// StartSpan starts a span as a child of the given traceparent, or a new
+// trace if the traceparent is empty or invalid
+func StartSpan(name string, kind int, traceParent string) (span *Span) {
+	span = &Span{
+		SpanID: randomID(8),
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+	}
+	traceId, parentId, ok := ParseTraceParent(traceParent)
+	if ok {
+		span.TraceID, span.ParentSpanID = traceId, parentId
+	} else {
+		span.TraceID = randomID(16)
+	}
+	return
+}
+
+// Child starts a child span of this span
+func (span *Span) Child(name string, kind int) *Span {
+	return StartSpan(name, kind, span.TraceParent())
+}
+
+// TraceParent is the W3C traceparent for this span, to propagate to the
+// next hop
+func (span *Span) TraceParent() string {
+	return "00-" + span.TraceID + "-" + span.SpanID + "-01"
+}
+
+// Set adds an attribute to the span
+func (span *Span) Set(key, value string) {
+	span.Attributes = append(span.Attributes, NewAttribute(key, value))
+}
+
+// Fail marks the span as failed
+func (span *Span) Fail(message string) {
+	span.Status = &Status{Code: 2, Message: message}
+}
+
+// End ends the span and queues it to be sent
+func (span *Span) End() {
+	span.StartTimeUnixNano = strconv.FormatInt(span.Start.UnixNano(), 10)
+	span.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+	spans.add(span)
+}
+
+// spans waiting to be sent, and what they are sent under and with
+var spans = &batch{}
+
+type batch struct {
+	mutex    sync.Mutex
+	spans    []*Span
+	resource []Attribute
+	scope    map[string]string
+	publish  func(data []byte)
+}
+
+// Setup sets the resource and instrumentation scope the spans are sent
+// under and the function that publishes them, which reports its own
+// errors, spans are dropped until it is called
+func Setup(resource []Attribute, scope map[string]string, publish func(data []byte)) {
+	spans.mutex.Lock()
+	defer spans.mutex.Unlock()
+	spans.resource, spans.scope, spans.publish = resource, scope, publish
+}
+
+func (b *batch) add(span *Span) {
+	b.mutex.Lock()
+	b.spans = append(b.spans, span)
+	full := len(b.spans) >= batchSize
+	b.mutex.Unlock()
+	if full {
+		Flush()
+	}
+}
+
+// Flush sends the queued spans as an OTLP export request
+func Flush() {
+	spans.mutex.Lock()
+	queued := spans.spans
+	spans.spans = nil
+	resource, scope, publish := spans.resource, spans.scope, spans.publish
+	spans.mutex.Unlock()
+	if len(queued) == 0 || publish == nil {
+		return
+	}
+	export := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": resource,
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": scope,
+						"spans": queued,
+					},
+				},
+			},
+		},
+	}
+	// spans only hold strings and numbers, so they always marshal
+	data, _ := json.Marshal(export)
+	publish(data)
+}
+
+// Export sends the queued spans every second
+func Export() {
+	for range time.Tick(time.Second) {
+		Flush()
+	}
+}
@@ -0,0 +1,70 @@
+package trace
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 ", true},
+		{"", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-xbf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+	}
+	for _, test := range tests {
+		traceId, spanId, ok := ParseTraceParent(test.header)
+		if ok != test.ok {
+			t.Errorf("%q: ok is %v", test.header, ok)
+		}
+		if ok && (traceId != "4bf92f3577b34da6a3ce929d0e0e4736" || spanId != "00f067aa0ba902b7") {
+			t.Errorf("%q: got %s %s", test.header, traceId, spanId)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	var published [][]byte
+	Setup([]Attribute{NewAttribute("service.name", "test")}, map[string]string{"name": "red"}, func(data []byte) {
+		published = append(published, data)
+	})
+	defer Setup(nil, nil, nil)
+
+	parent := StartSpan("parent", Server, "")
+	child := parent.Child("child", Internal)
+	if child.TraceID != parent.TraceID || child.ParentSpanID != parent.SpanID {
+		t.Errorf("child is not in its parent's trace: %+v", child)
+	}
+	child.Fail("failed")
+	child.End()
+	parent.End()
+	Flush()
+	if len(published) != 1 {
+		t.Fatalf("published %d batches, want 1", len(published))
+	}
+	var export struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []Span `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	err := json.Unmarshal(published[0], &export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans := export.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Name != "child" || spans[0].Status == nil || spans[1].Name != "parent" {
+		t.Errorf("unexpected spans %+v", spans)
+	}
+	Flush()
+	if len(published) != 1 {
+		t.Errorf("an empty batch was published")
+	}
+}